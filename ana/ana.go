@@ -3,14 +3,16 @@ package ana
 import (
 	"fmt"
 	"go/ast"
+	"go/token"
 	"go/types"
 
-	"golang.org/x/tools/go/loader"
+	"github.com/urso/gotools/load"
+	"github.com/urso/gotools/renamer"
 )
 
 func CollectIdentObjects(
-	prog *loader.Program,
-	info *loader.PackageInfo,
+	prog *load.Program,
+	info *load.PackageInfo,
 	id *ast.Ident,
 ) ([]types.Object, error) {
 	obj := info.Uses[id]
@@ -24,9 +26,7 @@ func CollectIdentObjects(
 			// Package clause?
 			_, path, _ := prog.PathEnclosingInterval(pos, pos)
 			if len(path) == 2 { // [Ident File]
-				// TODO(adonovan): support this case.
-				return nil, fmt.Errorf("cannot rename %q: renaming package clauses is not yet supported",
-					id)
+				return []types.Object{renamer.PackageClause(info.Pkg)}, nil
 			}
 
 			// Implicit y in "switch y := x.(type) {"?
@@ -60,3 +60,24 @@ func typeSwitchVar(info *types.Info, path []ast.Node) types.Object {
 	}
 	return nil
 }
+
+// IdentKey identifies an identifier by its location in the source code.
+// Unlike token.Pos, an IdentKey is valid in every program loaded from the
+// same sources, e.g. when loading a program for multiple build
+// configurations.
+type IdentKey struct {
+	Filename string
+	Offset   int
+}
+
+func KeyOf(fset *token.FileSet, id *ast.Ident) IdentKey {
+	p := fset.PositionFor(id.Pos(), false)
+	return IdentKey{Filename: p.Filename, Offset: p.Offset}
+}
+
+func (k IdentKey) Less(other IdentKey) bool {
+	if k.Filename != other.Filename {
+		return k.Filename < other.Filename
+	}
+	return k.Offset < other.Offset
+}
@@ -3,19 +3,20 @@ package main
 import (
 	"fmt"
 	"go/ast"
+	"log"
 	"strings"
 
 	"github.com/urso/gotools/ana"
 	"github.com/urso/gotools/filespec"
-	"golang.org/x/tools/go/loader"
+	"github.com/urso/gotools/load"
 )
 
 func collectExports(
-	prog *loader.Program,
+	prog *load.Program,
 	files []filespec.FileInfo,
 	filter func(string) bool,
-) map[*loader.PackageInfo][]exports {
-	pkgs := map[*loader.PackageInfo][]exports{}
+) map[*load.PackageInfo][]exports {
+	pkgs := map[*load.PackageInfo][]exports{}
 	for _, file := range files {
 		results := collectFileExports(prog, file, filter)
 		if len(results) == 0 {
@@ -28,7 +29,7 @@ func collectExports(
 }
 
 func collectFileExports(
-	prog *loader.Program,
+	prog *load.Program,
 	file filespec.FileInfo,
 	filter func(string) bool,
 ) []exports {
@@ -48,17 +49,86 @@ func collectFileExports(
 
 		objs, err := ana.CollectIdentObjects(prog, file.Package, id)
 		if err == nil {
-			es = append(es, exports{file: file, ident: id, objs: objs, scope: n})
+			es = append(es, exports{prog: prog, file: file, ident: id, objs: objs, scope: n})
 		}
 	}), file.File)
 	return es
 }
 
+// findUnusedExports returns all exported symbols in files and the subset of
+// symbols not used by any importer in prog.
+func findUnusedExports(
+	prog *load.Program,
+	files []filespec.FileInfo,
+	filter func(string) bool,
+) (allExported, unusedExports map[*load.PackageInfo][]exports) {
+	allExported = collectExports(prog, files, filter)
+
+	// filter out all unused exported symbols
+	unusedExports = map[*load.PackageInfo][]exports{}
+	for pkg, es := range allExported {
+		if verbose {
+			log.Println("process package: ", pkg.Pkg.Name())
+		}
+
+		// for every package importing pkg check if any exported symbols are used
+		importers := allImporters(prog, pkg)
+		if len(importers) == 0 {
+			unusedExports[pkg] = es
+			continue
+		}
+
+		used := make([]bool, len(es))
+		count := 0
+		for _, importer := range importers {
+			if verbose {
+				fmt.Println("check importer using symbols: ", importer.Pkg.Path())
+			}
+
+			for i, e := range es {
+				if used[i] {
+					continue
+				}
+
+				uses := usesExport(importer, e)
+				used[i] = uses
+				if uses {
+					count++
+				}
+			}
+		}
+
+		if count == 0 {
+			unusedExports[pkg] = es
+			continue
+		}
+		if count == len(es) {
+			// all symbols being used
+			continue
+		}
+
+		// if subset of exported symbols is not used,
+		// check if symbols are indirectly used due to type inference.
+		// e.g. an exported function should not return a unexported symbol
+		pkgUsed := make([]exports, 0, len(es)-count)
+		pkgUnused := make([]exports, 0, count)
+		for i, u := range used {
+			if !u {
+				pkgUnused = append(pkgUnused, es[i])
+			} else {
+				pkgUsed = append(pkgUsed, es[i])
+			}
+		}
+		unusedExports[pkg] = filterIndirectExports(pkgUsed, pkgUnused)
+	}
+	return allExported, unusedExports
+}
+
 func allImporters(
-	prog *loader.Program,
-	pkg *loader.PackageInfo,
-) (importers []*loader.PackageInfo) {
-	for _, other := range prog.Imported {
+	prog *load.Program,
+	pkg *load.PackageInfo,
+) (importers []*load.PackageInfo) {
+	for _, other := range prog.InitialPackages() {
 		if importsPackage(other, pkg) {
 			importers = append(importers, other)
 		}
@@ -66,7 +136,7 @@ func allImporters(
 	return
 }
 
-func importsPackage(pkg, imports *loader.PackageInfo) bool {
+func importsPackage(pkg, imports *load.PackageInfo) bool {
 	for _, i := range pkg.Pkg.Imports() {
 		if i == imports.Pkg {
 			return true
@@ -75,7 +145,7 @@ func importsPackage(pkg, imports *loader.PackageInfo) bool {
 	return false
 }
 
-func usesExport(info *loader.PackageInfo, e exports) bool {
+func usesExport(info *load.PackageInfo, e exports) bool {
 	for _, obj := range e.objs {
 		for id, other := range info.Uses {
 			if other == nil || other.Pkg() == nil {
@@ -1,42 +1,48 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"go/ast"
 	"go/build"
-	"go/format"
 	"go/token"
 	"go/types"
 	"log"
 	"os"
-	"strings"
-	"unicode"
-	"unicode/utf8"
+	"sort"
 
-	"golang.org/x/tools/go/loader"
-	"golang.org/x/tools/refactor/importgraph"
+	"golang.org/x/tools/go/buildutil"
 
+	"github.com/urso/gotools/ana"
 	"github.com/urso/gotools/filespec"
+	"github.com/urso/gotools/internal/cmdutil"
+	"github.com/urso/gotools/load"
 	"github.com/urso/gotools/names"
 	"github.com/urso/gotools/renamer"
+	"github.com/urso/gotools/workspace"
 	"github.com/urso/gotools/write"
 )
 
 type exports struct {
+	prog  *load.Program
 	file  filespec.FileInfo
 	ident *ast.Ident
 	scope ast.Node
 	objs  []types.Object
 }
 
+func (e exports) key() ana.IdentKey {
+	return ana.KeyOf(e.prog.Fset, e.ident)
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\t  [flags] # runs on package in current directory\n")
 	fmt.Fprintf(os.Stderr, "\t  [flags] package\n")
 	fmt.Fprintf(os.Stderr, "\t  [flags] directory\n")
 	fmt.Fprintf(os.Stderr, "\t  [flags] files... # must be a single package\n")
+	fmt.Fprintf(os.Stderr, "\t  [flags] undo [journal] # restore files changed by the last (or given) run\n")
+	fmt.Fprintf(os.Stderr, "\t  [flags] apply patchfile # apply patch created with -patch\n")
 	fmt.Fprintf(os.Stderr, "Flags:\n")
 	flag.PrintDefaults()
 }
@@ -50,40 +56,121 @@ var verbose = false
 
 func doMain() (rc int) {
 	diff := flag.Bool("d", false, "Display diff instead of rewriting")
-	diffCmd := flag.String("diff", "diff", "Diff command")
+	diffCmd := flag.String("diff", "", "external diff command (built-in unified diff if empty)")
+	diffContext := flag.Int("U", 3, "number of context lines in diffs")
+	diffColor := flag.Bool("color", false, "colorize diffs")
+	outDir := flag.String("out", "", "write modified files into a mirror of the workspace under `dir` instead of rewriting")
+	mirror := flag.String("mirror", "none", "mirror unmodified files into the -out directory: none, copy or symlink")
+	jsonOut := flag.Bool("json", false, "print the edits as JSON (LSP style text edits) instead of rewriting")
+	patch := flag.String("patch", "", "write all changes into a single patch `file` instead of rewriting files")
 	lintOnly := flag.Bool("l", false, "Lint mode")
 	ignoreConflicts := flag.Bool("c", false, "ignore conflicts (do not rename)")
 	verboseLogging := flag.Bool("v", false, "verbose")
 	initials := flag.String("initials", "", "Name Initialisms")
 	filter := registerFilterFlag("i", "e", " names regular expression")
+	var configs load.BuildConfigs
+	flag.Var(&configs, "configs", "build configurations to analyze (e.g. 'linux/amd64 windows/amd64,integration')")
+	since := flag.String("since", "", "only report identifiers declared in lines changed since git revision")
+	staged := flag.Bool("staged", false, "only report identifiers declared in lines staged in git")
+	var skip filespec.Patterns
+	flag.Var(&skip, "skip", "skip packages and files matching pattern (e.g. 'vendor', 'internal/legacy/...', '*_gen.go'); can be repeated")
+	filesFrom := flag.String("files-from", "", "read packages, directories and files to process from file, one per line ('-' for stdin)")
+	noJournal := flag.Bool("no-journal", false, "do not record a journal for undoing the changes")
+	overlayFile := flag.String("overlay", "", "JSON file mapping file paths to contents used instead of the files on disk ('-' for stdin)")
 
 	flag.Usage = usage
 	flag.Parse()
 
 	verbose = *verboseLogging
+	mirrorMode, err := write.ParseMirrorMode(*mirror)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "undo":
+			return cmdutil.Undo(args[1:], usage, verbose)
+		case "apply":
+			return cmdutil.Apply(args[1:], usage, !*noJournal)
+		}
+	}
+
 	args := flag.Args()
+	if *filesFrom != "" {
+		targets, err := filespec.ReadTargets(*filesFrom)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		args = append(args, targets...)
+	}
 	if len(args) == 0 {
 		args = []string{"."}
 	}
 
+	var overlay map[string][]byte
+	if *overlayFile != "" {
+		overlay, err = load.ReadOverlay(*overlayFile)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
 	fset := token.NewFileSet()
 	ctx := &build.Default
-	spec, err := filespec.New(ctx, args)
+	specCtx := ctx
+	if overlay != nil {
+		specCtx = buildutil.OverlayContext(ctx, overlay)
+	}
+	spec, err := filespec.New(specCtx, args)
 	if err != nil {
 		log.Println(err)
 		return 1
 	}
+	for _, warning := range spec.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", warning)
+	}
+	if len(skip) > 0 {
+		spec.Exclude(skip...)
+	}
+	if *since != "" || *staged {
+		changes, err := filespec.GitChanges(".", *since, *staged)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		spec.Restrict(specCtx, changes)
+	}
+	if len(spec.Packages) == 0 {
+		if verbose {
+			log.Println("no Go files to process")
+		}
+		return 0
+	}
 
-	prog, err := loadProgram(fset, ctx, spec.Packages)
+	loadConf := &load.Config{Fset: fset, Dir: spec.Dir, Overlay: overlay}
+	if verbose {
+		loadConf.Logf = log.Printf
+	}
+	// The snapshot records the files as loaded, such that files modified
+	// while the tool is running are not overwritten.
+	snapshot := write.Snapshot{}
+	progs, err := load.PackagesAll(loadConf, configs, spec.Packages)
 	if err != nil {
 		log.Println(err)
 		return 1
 	}
 
+	for _, prog := range progs {
+		snapshot.Add(prog.Hashes)
+	}
+
 	// Scan the workspace and build the import graph.
-	_, rev, errors := importgraph.Build(ctx)
+	_, rev, errors := workspace.Build(ctx, spec.Dir, configs, overlay)
 	if len(errors) > 0 {
-		// With a large GOPATH tree, errors are inevitable.
+		// With a large workspace, errors are inevitable.
 		// Report them but proceed.
 		fmt.Fprintf(os.Stderr, "While scanning Go workspace:\n")
 		for path, err := range errors {
@@ -100,181 +187,239 @@ func doMain() (rc int) {
 	}
 
 	// reload the larger program
-	prog, err = loadProgram(fset, ctx, packages)
-
-	// collect exported symbols
-	files := spec.CollectFiles(prog)
-	allExported := collectExports(prog, files, filter.report)
-	if len(allExported) == 0 {
-		fmt.Println("no exports found")
-		return
+	progs, err = load.PackagesAll(loadConf, configs, packages)
+	if err != nil {
+		log.Println(err)
+		return 1
 	}
 
-	// filter out all unused exported symbols
-	unusedExports := map[*loader.PackageInfo][]exports{}
-	if verbose {
-		log.Println("filter exported symbols")
+	for _, prog := range progs {
+		snapshot.Add(prog.Hashes)
 	}
-	for pkg, es := range allExported {
+
+	// Collect exported symbols per build configuration. An exported symbol
+	// is unused if it is not used in any of the build configurations
+	// declaring it.
+	declared := map[ana.IdentKey][]exports{}
+	used := map[ana.IdentKey]bool{}
+	for _, prog := range progs {
 		if verbose {
-			log.Println("process package: ", pkg.Pkg.Name())
+			log.Println("filter exported symbols for build configuration: ", prog.Build)
 		}
 
-		// for every package importing pkg check if any exported symbols are used
-		importers := allImporters(prog, pkg)
-		if len(importers) == 0 {
-			unusedExports[pkg] = es
-			continue
-		}
+		files := spec.CollectFiles(prog)
+		allExported, unusedExports := findUnusedExports(prog, files, filter.report)
 
-		used := make([]bool, len(es))
-		count := 0
-		for _, importer := range importers {
-			if verbose {
-				fmt.Println("check importer using symbols: ", importer.Pkg.Path())
+		unused := map[ana.IdentKey]bool{}
+		for _, es := range unusedExports {
+			for _, e := range es {
+				unused[e.key()] = true
 			}
-
-			for i, e := range es {
-				if used[i] {
+		}
+		for _, es := range allExported {
+			for _, e := range es {
+				if !spec.Changed(fset.Position(e.ident.Pos())) {
 					continue
 				}
 
-				uses := usesExport(importer, e)
-				used[i] = uses
-				if uses {
-					count++
+				key := e.key()
+				declared[key] = append(declared[key], e)
+				if !unused[key] {
+					used[key] = true
 				}
 			}
 		}
+	}
+	if len(declared) == 0 {
+		fmt.Println("no exports found")
+		return
+	}
 
-		if count == 0 {
-			unusedExports[pkg] = es
-			continue
-		}
-		if count == len(es) {
-			// all symbols being used
-			continue
-		}
-
-		// if subset of exported symbols is not used,
-		// check if symbols are indirectly used due to type inference.
-		// e.g. an exported function should not return a unexported symbol
-		pkgUsed := make([]exports, 0, len(es)-count)
-		pkgUnused := make([]exports, 0, count)
-		for i, u := range used {
-			if !u {
-				pkgUnused = append(pkgUnused, es[i])
-			} else {
-				pkgUsed = append(pkgUsed, es[i])
-			}
+	var unusedKeys []ana.IdentKey
+	for key := range declared {
+		if !used[key] {
+			unusedKeys = append(unusedKeys, key)
 		}
-		unusedExports[pkg] = filterIndirectExports(pkgUsed, pkgUnused)
 	}
+	sort.Slice(unusedKeys, func(i, j int) bool {
+		return unusedKeys[i].Less(unusedKeys[j])
+	})
 
 	// Print results if verbose or lint mode is enabled
 	// If lint mode is enabled, stop processing here
 	if verbose || *lintOnly {
-		if len(unusedExports) > 0 {
+		if len(unusedKeys) > 0 {
 			fmt.Println("Unused exports")
 		}
 
-		for pkg, es := range unusedExports {
-			fmt.Println("package: ", pkg.Pkg.Name())
-			for _, e := range es {
-				position := fset.Position(e.ident.Pos())
-				fmt.Printf("    unused export at %v: %v\n", position, e.ident.String())
+		pkgName := ""
+		for _, key := range unusedKeys {
+			e := declared[key][0]
+			if name := e.file.Package.Pkg.Name(); name != pkgName {
+				pkgName = name
+				fmt.Println("package: ", name)
 			}
+			position := fset.Position(e.ident.Pos())
+			fmt.Printf("    unused export at %v: %v\n", position, e.ident.String())
 		}
 
 		if *lintOnly {
-			if len(unusedExports) > 0 {
+			if len(unusedKeys) > 0 {
 				return 1
 			}
 			return 0
 		}
 	}
 
+	// create writer before updating the programs, so the journal records
+	// all renames
+	edits := write.EditSet{}
+	writer, err := write.CreateWriter(write.Options{
+		Diff:     *diff,
+		DiffCmd:  *diffCmd,
+		Patch:    *patch,
+		OutDir:   *outDir,
+		Mirror:   mirrorMode,
+		JSON:     *jsonOut,
+		Edits:    edits,
+		Snapshot: snapshot,
+		DiffOptions: write.DiffOptions{
+			Context: *diffContext,
+			Color:   *diffColor,
+			Root:    cmdutil.WorkspaceRoot(),
+			Overlay: overlay,
+		},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var journal *write.Journal
+	if !*diff && *patch == "" && !*jsonOut && *outDir == "" && !*noJournal {
+		journal = write.NewJournal(cmdutil.JournalDir())
+		writer = journal.Writer(writer)
+	}
+
 	// start renaming symbols in memory
 	if verbose {
 		fmt.Println("try renaming unused exports")
 	}
 
+	// All renames are checked together against the original programs
+	// before any program is updated, one batch per build configuration.
+	// The renaming must be valid in every build configuration declaring
+	// the symbol. If conflicts are ignored, conflicting renames are dropped
+	// and the remaining renames are checked again.
 	initialisms := names.NewInitials(*initials)
-	updatedFiles := map[*token.File]bool{}
-	for pkg, es := range unusedExports {
-		if verbose {
-			fmt.Println("process package: ", pkg.Pkg.Name())
+	keys := unusedKeys
+	var renamers map[ana.IdentKey][]*renamer.Renamer
+	var batches map[*load.Program]*renamer.Batch
+	for {
+		renamers = map[ana.IdentKey][]*renamer.Renamer{}
+		batches = map[*load.Program]*renamer.Batch{}
+		owner := map[*renamer.Renamer]ana.IdentKey{}
+		for _, key := range keys {
+			to := names.Unexport(declared[key][0].ident.Name, initialisms)
+			for _, e := range declared[key] {
+				b := batches[e.prog]
+				if b == nil {
+					b = renamer.NewBatch(e.prog)
+					b.AddAllPackages(e.prog.InitialPackages()...)
+					b.Protect(filespec.ProtectGenerated)
+					b.Protect(filespec.ProtectVendored)
+					batches[e.prog] = b
+				}
+				r := b.Add(to, e.objs...)
+				renamers[key] = append(renamers[key], r)
+				owner[r] = key
+			}
 		}
 
-		for _, e := range es {
-			r := renamer.New(prog, unexportedName(e.ident.Name, initialisms))
-			r.AddAllPackages(prog.InitialPackages()...)
-
-			files, err := r.Update(e.objs...)
-			if err != nil {
+		failed := map[ana.IdentKey]bool{}
+		for _, prog := range progs {
+			b := batches[prog]
+			if b == nil {
+				continue
+			}
+			if err := b.Check(); err != nil {
+				err = cmdutil.ReportConflicts(err)
+				if len(progs) > 1 {
+					err = fmt.Errorf("%v (build configuration %v)", err, prog.Build)
+				}
 				fmt.Fprintln(os.Stderr, "renaming failed with: ", err)
-				if !(*ignoreConflicts) {
-					return 1
+				for _, r := range b.Failed() {
+					failed[owner[r]] = true
 				}
-				fmt.Fprintln(os.Stderr, "ignore renaming conflict")
 			}
+		}
+		if len(failed) == 0 {
+			break
+		}
+		if !(*ignoreConflicts) {
+			return 1
+		}
 
-			for file := range files {
-
-				if verbose {
-					log.Println("updated: ", file.Name())
-				}
-				updatedFiles[file] = true
+		remaining := keys[:0:0]
+		for _, key := range keys {
+			if failed[key] {
+				fmt.Fprintf(os.Stderr, "ignore renaming conflict of %v\n", declared[key][0].ident.Name)
+				continue
 			}
+			remaining = append(remaining, key)
 		}
+		keys = remaining
 	}
 
-	// serialize changes for all files changed into buffers
-	changed := map[string][]byte{}
-	// write changed files to stdout
-	for _, info := range prog.InitialPackages() {
-		for _, f := range info.Files {
-			tokenFile := prog.Fset.File(f.Pos())
-			if !updatedFiles[tokenFile] {
-				continue
-			}
+	// Updating the programs renames the declared identifiers. Keep the
+	// original names for the journal.
+	from := make(map[ana.IdentKey]string, len(keys))
+	for _, key := range keys {
+		from[key] = declared[key][0].ident.Name
+	}
 
-			var buf bytes.Buffer
-			err := format.Node(&buf, prog.Fset, f)
-			if err != nil {
-				log.Printf("failed to pretty-print syntax tree: %v", err)
-				return 1
+	for _, prog := range progs {
+		b := batches[prog]
+		if b == nil {
+			continue
+		}
+		files, err := b.Update()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "renaming failed with: ", err)
+			return 1
+		}
+		if verbose {
+			for file := range files {
+				log.Println("updated: ", file.Name())
 			}
-
-			changed[tokenFile.Name()] = buf.Bytes()
+		}
+	}
+	for _, key := range keys {
+		es := declared[key]
+		for i, e := range es {
+			cmdutil.RecordEdits(edits, e.prog.Fset, renamers[key][i].Edits(), "unused export")
+		}
+		if journal != nil {
+			journal.AddRename(fset.Position(es[0].ident.Pos()), from[key], names.Unexport(from[key], initialisms))
 		}
 	}
 
-	// update files
-	writer, err := write.CreateWriter(*diff, *diffCmd)
+	// splice the renamed identifiers into the original files
+	changed, err := edits.Apply(overlay, snapshot)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		cmdutil.ReportWriteError(err)
 		return 1
 	}
-	for file, buf := range changed {
-		if verbose {
+
+	// update files
+	if verbose {
+		for _, file := range changed.Files() {
 			log.Println("update file: ", file)
 		}
-		writer.Write(file, buf)
-	}
-
-	return
-}
-
-func unexportedName(n string, initialisms *names.Initials) string {
-	if n == "" {
-		return ""
 	}
-
-	if i := initialisms.StartsWith(n); i != "" {
-		return strings.ToLower(i) + n[len(i):]
+	if err := write.WriteAll(writer, changed); err != nil {
+		cmdutil.ReportWriteError(err)
+		return 1
 	}
 
-	r, _ := utf8.DecodeRuneInString(n)
-	return string(unicode.ToLower(r)) + n[1:]
+	return
 }
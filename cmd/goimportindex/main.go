@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/build"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"golang.org/x/tools/refactor/importgraph"
+
+	"github.com/urso/gotools/load"
+	"github.com/urso/gotools/workspace"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\t  [flags] [info] # print index location and statistics\n")
+	fmt.Fprintf(os.Stderr, "\t  [flags] rebuild # discard index and scan all packages\n")
+	fmt.Fprintf(os.Stderr, "\t  [flags] imports packages... # print packages imported\n")
+	fmt.Fprintf(os.Stderr, "\t  [flags] importers packages... # print packages importing (transitively)\n")
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	rc := doMain()
+	os.Exit(rc)
+}
+
+func doMain() int {
+	dir := flag.String("C", ".", "directory in workspace to index")
+	verbose := flag.Bool("v", false, "verbose")
+	var configs load.BuildConfigs
+	flag.Var(&configs, "configs", "build configurations to index (e.g. 'linux/amd64 windows/amd64,integration')")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	cmd, args := "info", flag.Args()
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "info", "rebuild":
+		if len(args) > 0 {
+			usage()
+			return 2
+		}
+	case "imports", "importers":
+		if len(args) == 0 {
+			usage()
+			return 2
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd)
+		usage()
+		return 2
+	}
+
+	ws, err := workspace.Find(*dir)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	if len(configs) == 0 {
+		configs = load.BuildConfigs{{}}
+	}
+
+	rc := 0
+	for _, c := range configs {
+		start := time.Now()
+		idx := workspace.OpenIndex(c.Context(&build.Default), ws)
+		if cmd == "rebuild" {
+			idx.Reset()
+		}
+		updated := idx.Update()
+		if err := idx.Save(); err != nil {
+			log.Println(err)
+			rc = 1
+		}
+		if *verbose {
+			log.Printf("build configuration %v: updated %v packages in %v", c, updated, time.Since(start))
+		}
+
+		graph, errors := idx.Graph()
+		switch cmd {
+		case "info", "rebuild":
+			edges := 0
+			for _, tos := range graph {
+				edges += len(tos)
+			}
+
+			fmt.Printf("build configuration: %v\n", c)
+			fmt.Printf("    index file: %v\n", idx.File)
+			fmt.Printf("    packages: %v\n", len(idx.Packages))
+			fmt.Printf("    import edges: %v\n", edges)
+			fmt.Printf("    packages updated: %v\n", updated)
+			fmt.Printf("    packages with errors: %v\n", len(errors))
+
+		case "imports":
+			for _, pkg := range args {
+				for _, imp := range sortedKeys(graph[pkg]) {
+					fmt.Println(imp)
+				}
+			}
+
+		case "importers":
+			reverse := importgraph.Graph{}
+			for from, tos := range graph {
+				for to := range tos {
+					if reverse[to] == nil {
+						reverse[to] = map[string]bool{}
+					}
+					reverse[to][from] = true
+				}
+			}
+
+			importers := reverse.Search(args...)
+			for _, pkg := range args {
+				delete(importers, pkg)
+			}
+			for _, pkg := range sortedKeys(importers) {
+				fmt.Println(pkg)
+			}
+		}
+	}
+	return rc
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
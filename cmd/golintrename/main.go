@@ -1,34 +1,36 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"go/ast"
 	"go/build"
-	"go/format"
 	"go/token"
 	"log"
 	"os"
+	"sort"
 	"strings"
 
+	"golang.org/x/tools/go/buildutil"
+
 	"github.com/urso/gotools/ana"
 	"github.com/urso/gotools/filespec"
+	"github.com/urso/gotools/internal/cmdutil"
+	"github.com/urso/gotools/load"
 	"github.com/urso/gotools/names"
 	"github.com/urso/gotools/renamer"
+	"github.com/urso/gotools/workspace"
 	"github.com/urso/gotools/write"
-
-	"golang.org/x/tools/go/loader"
-	"golang.org/x/tools/refactor/importgraph"
 )
 
 type fileInfo struct {
-	pkg  *loader.PackageInfo
+	pkg  *load.PackageInfo
 	path string
 	file *ast.File
 }
 
 type correction struct {
+	prog   *load.Program
 	file   filespec.FileInfo
 	ident  *ast.Ident
 	should string
@@ -42,6 +44,8 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "\t  [flags] package\n")
 	fmt.Fprintf(os.Stderr, "\t  [flags] directory\n")
 	fmt.Fprintf(os.Stderr, "\t  [flags] files... # must be a single package\n")
+	fmt.Fprintf(os.Stderr, "\t  [flags] undo [journal] # restore files changed by the last (or given) run\n")
+	fmt.Fprintf(os.Stderr, "\t  [flags] apply patchfile # apply patch created with -patch\n")
 	fmt.Fprintf(os.Stderr, "Flags:\n")
 	flag.PrintDefaults()
 }
@@ -51,59 +55,165 @@ func main() {
 	os.Exit(rc)
 }
 
-var verbose = false
+var (
+	verbose        = false
+	renamePackages = false
+)
 
 func doMain() int {
 	diff := flag.Bool("d", false, "Display diff instead of rewriting")
-	diffCmd := flag.String("diff", "diff", "Diff command")
+	diffCmd := flag.String("diff", "", "external diff command (built-in unified diff if empty)")
+	diffContext := flag.Int("U", 3, "number of context lines in diffs")
+	diffColor := flag.Bool("color", false, "colorize diffs")
+	outDir := flag.String("out", "", "write modified files into a mirror of the workspace under `dir` instead of rewriting")
+	mirror := flag.String("mirror", "none", "mirror unmodified files into the -out directory: none, copy or symlink")
+	jsonOut := flag.Bool("json", false, "print the edits as JSON (LSP style text edits) instead of rewriting")
+	patch := flag.String("patch", "", "write all changes into a single patch `file` instead of rewriting files")
 	initials := flag.String("i", "", "additional initialisms")
+	pkgNames := flag.Bool("pkgnames", false, "also rename packages whose names do not follow the Go naming conventions")
 	verboseLogging := flag.Bool("v", false, "verbose")
+	var configs load.BuildConfigs
+	flag.Var(&configs, "configs", "build configurations to analyze (e.g. 'linux/amd64 windows/amd64,integration')")
+	since := flag.String("since", "", "only report identifiers declared in lines changed since git revision")
+	staged := flag.Bool("staged", false, "only report identifiers declared in lines staged in git")
+	var skip filespec.Patterns
+	flag.Var(&skip, "skip", "skip packages and files matching pattern (e.g. 'vendor', 'internal/legacy/...', '*_gen.go'); can be repeated")
+	filesFrom := flag.String("files-from", "", "read packages, directories and files to process from file, one per line ('-' for stdin)")
+	noJournal := flag.Bool("no-journal", false, "do not record a journal for undoing the changes")
+	overlayFile := flag.String("overlay", "", "JSON file mapping file paths to contents used instead of the files on disk ('-' for stdin)")
 
 	flag.Usage = usage
 	flag.Parse()
 
 	verbose = *verboseLogging
+	renamePackages = *pkgNames
+	mirrorMode, err := write.ParseMirrorMode(*mirror)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "undo":
+			return cmdutil.Undo(args[1:], usage, verbose)
+		case "apply":
+			return cmdutil.Apply(args[1:], usage, !*noJournal)
+		}
+	}
+
+	var overlay map[string][]byte
+	if *overlayFile != "" {
+		overlay, err = load.ReadOverlay(*overlayFile)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
 
-	writer, err := write.CreateWriter(*diff, *diffCmd)
+	// The snapshot records the files as loaded, such that files modified
+	// while the tool is running are not overwritten. Snapshot and edits are
+	// filled once the packages have been loaded and renamed.
+	snapshot := write.Snapshot{}
+	edits := write.EditSet{}
+	writer, err := write.CreateWriter(write.Options{
+		Diff:     *diff,
+		DiffCmd:  *diffCmd,
+		Patch:    *patch,
+		OutDir:   *outDir,
+		Mirror:   mirrorMode,
+		JSON:     *jsonOut,
+		Edits:    edits,
+		Snapshot: snapshot,
+		DiffOptions: write.DiffOptions{
+			Context: *diffContext,
+			Color:   *diffColor,
+			Root:    cmdutil.WorkspaceRoot(),
+			Overlay: overlay,
+		},
+	})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return 1
 	}
+	var journal *write.Journal
+	if !*diff && *patch == "" && !*jsonOut && *outDir == "" && !*noJournal {
+		journal = write.NewJournal(cmdutil.JournalDir())
+		writer = journal.Writer(writer)
+	}
 
 	args := flag.Args()
+	if *filesFrom != "" {
+		targets, err := filespec.ReadTargets(*filesFrom)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		args = append(args, targets...)
+	}
 	if len(args) == 0 {
 		args = []string{"."}
 	}
 
 	fset := token.NewFileSet()
 	ctx := &build.Default
-	spec, err := filespec.New(ctx, args)
+	specCtx := ctx
+	if overlay != nil {
+		specCtx = buildutil.OverlayContext(ctx, overlay)
+	}
+	spec, err := filespec.New(specCtx, args)
 	if err != nil {
 		log.Println(err)
 		return 1
 	}
+	for _, warning := range spec.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", warning)
+	}
+	if len(skip) > 0 {
+		spec.Exclude(skip...)
+	}
+	if *since != "" || *staged {
+		changes, err := filespec.GitChanges(".", *since, *staged)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		spec.Restrict(specCtx, changes)
+	}
+	if len(spec.Packages) == 0 {
+		if verbose {
+			log.Println("no Go files to process")
+		}
+		return 0
+	}
 
-	prog, err := loadProgram(fset, ctx, spec.Packages)
+	loadConf := &load.Config{Fset: fset, Dir: spec.Dir, Overlay: overlay}
+	if verbose {
+		loadConf.Logf = log.Printf
+	}
+	progs, err := load.PackagesAll(loadConf, configs, spec.Packages)
 	if err != nil {
 		log.Println(err)
 		return 1
 	}
 
+	for _, prog := range progs {
+		snapshot.Add(prog.Hashes)
+	}
+
 	// analyze all given files for naming errors
 	initialisms := names.NewInitials(*initials)
-	files := spec.CollectFiles(prog)
-	names := analyzeAllNames(fset, files, initialisms)
+	corrections := analyzeAllConfigs(progs, spec, initialisms)
 
 	// check for exports and reload program + names if necessary
-	if requiresGlobal(names) {
+	if requiresGlobal(corrections) {
 		if verbose {
 			log.Print("Potentially global renaming; scanning workspace...")
 		}
 
 		// Scan the workspace and build the import graph.
-		_, rev, errors := importgraph.Build(ctx)
+		_, rev, errors := workspace.Build(ctx, spec.Dir, configs, overlay)
 		if len(errors) > 0 {
-			// With a large GOPATH tree, errors are inevitable.
+			// With a large workspace, errors are inevitable.
 			// Report them but proceed.
 			fmt.Fprintf(os.Stderr, "While scanning Go workspace:\n")
 			for path, err := range errors {
@@ -120,136 +230,234 @@ func doMain() int {
 		}
 
 		// reload the larger program
-		prog, err = loadProgram(fset, ctx, affectedPackages)
+		progs, err = load.PackagesAll(loadConf, configs, affectedPackages)
 		if err != nil {
 			log.Println(err)
 			return 1
 		}
 
+		for _, prog := range progs {
+			snapshot.Add(prog.Hashes)
+		}
+
 		// re-analyze renamings symbols from larger corpus
-		files = spec.CollectFiles(prog)
-		names = analyzeAllNames(fset, files, initialisms)
+		corrections = analyzeAllConfigs(progs, spec, initialisms)
 	}
 
 	// print all found symbols for testing
 	if verbose {
-		for pkg, files := range names {
-			log.Println("package: ", pkg)
-			for filename, cs := range files {
-				log.Println("  file:", filename)
-				for _, c := range cs {
-					exported := "exported"
-					if !c.ident.IsExported() {
-						exported = ""
-					}
-					log.Printf("    %v should rename %v %v %v to %v\n",
-						c.pos, exported, c.thing, c.ident.Name, c.should)
-					log.Println(c.ident.Obj)
-				}
+		for _, cs := range corrections {
+			c := cs[0]
+			exported := "exported"
+			if !c.ident.IsExported() {
+				exported = ""
 			}
+			log.Printf("%v should rename %v %v %v to %v\n",
+				c.pos, exported, c.thing, c.ident.Name, c.should)
+			log.Println(c.ident.Obj)
 		}
 	}
 
-	packages := make([]*loader.PackageInfo, 0, len(prog.Imported)+len(prog.Created))
-	for _, info := range prog.Imported {
-		packages = append(packages, info)
+	// start renaming symbols
+	if !renameAll(progs, corrections, edits, journal) {
+		return 1
 	}
-	for _, info := range prog.Created {
-		packages = append(packages, info)
+
+	// splice the renamed identifiers into the original files
+	changed, err := edits.Apply(overlay, snapshot)
+	if err != nil {
+		cmdutil.ReportWriteError(err)
+		return 1
 	}
 
-	// start renaming symbols
-	updatedFiles := map[*token.File]bool{}
-	for pkg, files := range names {
-		if verbose {
-			log.Println("process package: ", pkg)
+	// write changed files
+	if verbose {
+		for _, file := range changed.Files() {
+			log.Println("update file: ", file)
 		}
-		for filename, cs := range files {
-			if verbose {
-				log.Println("  process file:", filename)
-			}
-			for _, c := range cs {
-				if verbose {
-					log.Printf("process %v -> %v\n", c.ident.Name, c.should)
-				}
-
-				objs, err := ana.CollectIdentObjects(prog, c.file.Package, c.ident)
-				if err != nil {
-					fmt.Println(err)
-					return 1
-				}
+	}
+	if err := write.WriteAll(writer, changed); err != nil {
+		cmdutil.ReportWriteError(err)
+		return 1
+	}
 
-				r := renamer.New(prog, c.should)
-				r.AddAllPackages(packages...)
+	return 0
+}
 
-				files, err := r.Update(objs...)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "renaming failed with: ", err)
-					return 1
-				}
-				for file := range files {
-					if verbose {
-						log.Println("updated: ", file.Name())
-					}
-					updatedFiles[file] = true
-				}
-			}
+// renameAll applies the corrections to the programs and records the edits
+// and renames in edits and journal. The journal is optional. Conflicts and
+// errors are reported, with renameAll returning false if any correction can
+// not be applied.
+func renameAll(
+	progs []*load.Program,
+	corrections [][]correction,
+	edits write.EditSet,
+	journal *write.Journal,
+) bool {
+	// All renames are checked together against the original programs
+	// before any program is updated, one batch per build configuration.
+	// The renaming must be valid in every build configuration declaring
+	// the symbol.
+	batches := map[*load.Program]*renamer.Batch{}
+	renamers := make([][]*renamer.Renamer, len(corrections))
+	for i, cs := range corrections {
+		if verbose {
+			log.Printf("process %v -> %v\n", cs[0].ident.Name, cs[0].should)
 		}
-	}
 
-	// serialize changes for all files changed into buffers
-	changed := map[string][]byte{}
-	// write changed files to stdout
-	for _, info := range packages {
-		for _, f := range info.Files {
-			tokenFile := prog.Fset.File(f.Pos())
-			if !updatedFiles[tokenFile] {
-				continue
+		for _, c := range cs {
+			objs, err := ana.CollectIdentObjects(c.prog, c.file.Package, c.ident)
+			if err != nil {
+				fmt.Println(err)
+				return false
 			}
 
-			var buf bytes.Buffer
-			err := format.Node(&buf, prog.Fset, f)
-			if err != nil {
-				log.Printf("failed to pretty-print syntax tree: %v", err)
-				return 1
+			b := batches[c.prog]
+			if b == nil {
+				b = renamer.NewBatch(c.prog)
+				b.AddAllPackages(c.prog.InitialPackages()...)
+				b.Protect(filespec.ProtectGenerated)
+				b.Protect(filespec.ProtectVendored)
+				batches[c.prog] = b
 			}
+			renamers[i] = append(renamers[i], b.Add(c.should, objs...))
+		}
+	}
 
-			changed[tokenFile.Name()] = buf.Bytes()
+	failed := false
+	for _, prog := range progs {
+		b := batches[prog]
+		if b == nil {
+			continue
 		}
+		if err := b.Check(); err != nil {
+			err = cmdutil.ReportConflicts(err)
+			if len(progs) > 1 {
+				err = fmt.Errorf("%v (build configuration %v)", err, prog.Build)
+			}
+			fmt.Fprintln(os.Stderr, "renaming failed with: ", err)
+			failed = true
+		}
+	}
+	if failed {
+		return false
 	}
 
-	// write changed files
-	for file, buf := range changed {
+	// Updating the programs renames the identifiers of the corrections.
+	// Keep the original names for the edit reasons and the journal.
+	from := make([]string, len(corrections))
+	for i, cs := range corrections {
+		from[i] = cs[0].ident.Name
+	}
+
+	for _, prog := range progs {
+		b := batches[prog]
+		if b == nil {
+			continue
+		}
+		files, err := b.Update()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "renaming failed with: ", err)
+			return false
+		}
 		if verbose {
-			log.Println("update file: ", file)
+			for file := range files {
+				log.Println("updated: ", file.Name())
+			}
+		}
+	}
+	for i, cs := range corrections {
+		for j, c := range cs {
+			reason := fmt.Sprintf("%v %v should be %v", c.thing, from[i], c.should)
+			cmdutil.RecordEdits(edits, c.prog.Fset, renamers[i][j].Edits(), reason)
+		}
+		if journal != nil {
+			journal.AddRename(cs[0].pos, from[i], cs[0].should)
 		}
-		writer.Write(file, buf)
 	}
+	return true
+}
 
-	return 0
+func requiresGlobal(corrections [][]correction) bool {
+	for _, cs := range corrections {
+		if cs[0].ident.IsExported() || cs[0].thing == "package" {
+			return true
+		}
+	}
+	return false
 }
 
-func requiresGlobal(names map[string]map[string][]correction) bool {
-	for _, files := range names {
-		for _, cs := range files {
-			for _, c := range cs {
-				if c.ident.IsExported() {
-					return true
+// analyzeAllConfigs analyzes the names in all build configurations.
+// Corrections of the same identifier found in multiple build configurations
+// are grouped, with groups being ordered by source position.
+func analyzeAllConfigs(
+	progs []*load.Program,
+	spec *filespec.Spec,
+	initialisms *names.Initials,
+) [][]correction {
+	grouped := map[ana.IdentKey][]correction{}
+	var keys []ana.IdentKey
+
+	// The package clause is reported for every file, but renamed in all
+	// files of the package at once. Corrections of the package clause are
+	// grouped by the first one found.
+	type packageKey struct {
+		prog *load.Program
+		path string
+	}
+	packageKeys := map[string]ana.IdentKey{}
+	seenPackages := map[packageKey]bool{}
+
+	for _, prog := range progs {
+		files := spec.CollectFiles(prog)
+		for _, files := range analyzeAllNames(prog, files, initialisms) {
+			for _, cs := range files {
+				for _, c := range cs {
+					if !spec.Changed(c.pos) {
+						continue
+					}
+
+					key := ana.KeyOf(prog.Fset, c.ident)
+					if c.thing == "package" {
+						path := c.file.Package.Pkg.Path()
+						if seenPackages[packageKey{prog, path}] {
+							continue
+						}
+						seenPackages[packageKey{prog, path}] = true
+						if first, exists := packageKeys[path]; exists {
+							key = first
+						} else {
+							packageKeys[path] = key
+						}
+					}
+
+					if _, exists := grouped[key]; !exists {
+						keys = append(keys, key)
+					}
+					grouped[key] = append(grouped[key], c)
 				}
 			}
 		}
 	}
-	return false
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Less(keys[j])
+	})
+	corrections := make([][]correction, len(keys))
+	for i, key := range keys {
+		corrections[i] = grouped[key]
+	}
+	return corrections
 }
 
 func analyzeAllNames(
-	fset *token.FileSet,
+	prog *load.Program,
 	files []filespec.FileInfo,
 	initialisms *names.Initials,
 ) map[string]map[string][]correction {
 	pkgs := map[string]map[string][]correction{}
 	for _, file := range files {
-		results := analyzeNames(fset, file, initialisms)
+		results := analyzeNames(prog, file, initialisms)
 		if len(results) == 0 {
 			continue
 		}
@@ -267,7 +475,7 @@ func analyzeAllNames(
 }
 
 func analyzeNames(
-	fset *token.FileSet,
+	prog *load.Program,
 	file filespec.FileInfo,
 	initialisms *names.Initials,
 ) []correction {
@@ -275,16 +483,33 @@ func analyzeNames(
 	isTest := strings.HasSuffix(path, "_test.go")
 
 	corrections := []correction{}
+
+	// The package clause of external test packages is renamed with the
+	// package under test.
+	if id := file.File.Name; renamePackages && !strings.HasSuffix(id.Name, "_test") {
+		if should := names.LintPackage(id.Name); should != id.Name && id.Name != "main" {
+			corrections = append(corrections, correction{
+				prog:   prog,
+				file:   file,
+				ident:  id,
+				should: should,
+				thing:  "package",
+				pos:    prog.Fset.Position(id.NamePos),
+			})
+		}
+	}
+
 	iterNameDecls(isTest, file.File, func(id *ast.Ident, thing string) {
 		name := id.Name
-		should := lintName(name, initialisms)
+		should := names.Lint(name, initialisms)
 		if name != should {
 			corrections = append(corrections, correction{
+				prog:   prog,
 				file:   file,
 				ident:  id,
 				should: should,
 				thing:  thing,
-				pos:    fset.Position(id.NamePos),
+				pos:    prog.Fset.Position(id.NamePos),
 			})
 		}
 	})
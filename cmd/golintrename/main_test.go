@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urso/gotools/filespec"
+	"github.com/urso/gotools/load"
+	"github.com/urso/gotools/names"
+	"github.com/urso/gotools/write"
+)
+
+func TestRenameAllJournal(t *testing.T) {
+	testdata, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &load.Config{
+		Dir: filepath.Join(testdata, "src"),
+		Env: append(os.Environ(), "GOPATH="+testdata, "GO111MODULE=off", "GOPROXY=off", "GOFLAGS="),
+	}
+	prog, err := load.Packages(conf, map[string]bool{"a": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var corrections [][]correction
+	info := prog.Package("a")
+	for _, file := range info.Files {
+		fi := filespec.FileInfo{
+			Package: info,
+			Path:    prog.Fset.File(file.Pos()).Name(),
+			File:    file,
+		}
+		for _, c := range analyzeNames(prog, fi, names.NewInitials("")) {
+			corrections = append(corrections, []correction{c})
+		}
+	}
+
+	edits := write.EditSet{}
+	journal := write.NewJournal(t.TempDir())
+	if !renameAll([]*load.Program{prog}, corrections, edits, journal) {
+		t.Fatal("renaming failed")
+	}
+
+	expected := []write.Rename{
+		{From: "HttpClient", To: "HTTPClient"},
+		{From: "GetId", To: "GetID"},
+		{From: "NewHttpClient", To: "NewHTTPClient"},
+	}
+	if len(journal.Renames) != len(expected) {
+		t.Fatalf("journal records %v renames, want %v: %v", len(journal.Renames), len(expected), journal.Renames)
+	}
+	for i, r := range journal.Renames {
+		if r.From != expected[i].From || r.To != expected[i].To {
+			t.Errorf("rename %v: got %v -> %v, want %v -> %v", i, r.From, r.To, expected[i].From, expected[i].To)
+		}
+	}
+
+	for _, file := range edits.Files() {
+		for _, e := range edits[file] {
+			if !strings.Contains(e.Reason, " "+e.OldName+" should be "+e.NewName) {
+				t.Errorf("edit of %v has unexpected reason %q", e.OldName, e.Reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package a
+
+type HttpClient struct{}
+
+func (c *HttpClient) GetId() int { return 0 }
+
+func NewHttpClient() *HttpClient { return &HttpClient{} }
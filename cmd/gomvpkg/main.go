@@ -0,0 +1,288 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/build"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/buildutil"
+
+	"github.com/urso/gotools/filespec"
+	"github.com/urso/gotools/internal/cmdutil"
+	"github.com/urso/gotools/load"
+	"github.com/urso/gotools/renamer"
+	"github.com/urso/gotools/workspace"
+	"github.com/urso/gotools/write"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\t  [flags] package newpath # moves package (import path or directory) to import path newpath\n")
+	fmt.Fprintf(os.Stderr, "\t  [flags] undo [journal] # restore files changed by the last (or given) run\n")
+	fmt.Fprintf(os.Stderr, "\t  [flags] apply patchfile # apply patch created with -patch\n")
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	rc := doMain()
+	os.Exit(rc)
+}
+
+var verbose = false
+
+func doMain() int {
+	diff := flag.Bool("d", false, "Display diff instead of rewriting")
+	diffCmd := flag.String("diff", "", "external diff command (built-in unified diff if empty)")
+	diffContext := flag.Int("U", 3, "number of context lines in diffs")
+	diffColor := flag.Bool("color", false, "colorize diffs")
+	outDir := flag.String("out", "", "write modified files into a mirror of the workspace under `dir` instead of rewriting")
+	mirror := flag.String("mirror", "none", "mirror unmodified files into the -out directory: none, copy or symlink")
+	jsonOut := flag.Bool("json", false, "print the edits as JSON (LSP style text edits) instead of rewriting")
+	patch := flag.String("patch", "", "write all changes into a single patch `file` instead of rewriting files")
+	verboseLogging := flag.Bool("v", false, "verbose")
+	var configs load.BuildConfigs
+	flag.Var(&configs, "configs", "build configurations to analyze (e.g. 'linux/amd64 windows/amd64,integration')")
+	noJournal := flag.Bool("no-journal", false, "do not record a journal for undoing the changes")
+	overlayFile := flag.String("overlay", "", "JSON file mapping file paths to contents used instead of the files on disk ('-' for stdin)")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	verbose = *verboseLogging
+	mirrorMode, err := write.ParseMirrorMode(*mirror)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	args := flag.Args()
+	if len(args) > 0 {
+		switch args[0] {
+		case "undo":
+			return cmdutil.Undo(args[1:], usage, verbose)
+		case "apply":
+			return cmdutil.Apply(args[1:], usage, !*noJournal)
+		}
+	}
+	if len(args) != 2 {
+		usage()
+		return 2
+	}
+
+	var overlay map[string][]byte
+	if *overlayFile != "" {
+		overlay, err = load.ReadOverlay(*overlayFile)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
+	// The snapshot records the files as loaded, such that files modified
+	// while the tool is running are not overwritten. Snapshot, edits and
+	// the modes of the moved files are filled once the packages have been
+	// loaded and moved.
+	snapshot := write.Snapshot{}
+	edits := write.EditSet{}
+	modes := write.FileModes{}
+	writer, err := write.CreateWriter(write.Options{
+		Diff:     *diff,
+		DiffCmd:  *diffCmd,
+		Patch:    *patch,
+		OutDir:   *outDir,
+		Mirror:   mirrorMode,
+		JSON:     *jsonOut,
+		Edits:    edits,
+		Snapshot: snapshot,
+		DiffOptions: write.DiffOptions{
+			Context: *diffContext,
+			Color:   *diffColor,
+			Root:    cmdutil.WorkspaceRoot(),
+			Overlay: overlay,
+			Modes:   modes,
+		},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var journal *write.Journal
+	if !*diff && *patch == "" && !*jsonOut && *outDir == "" && !*noJournal {
+		journal = write.NewJournal(cmdutil.JournalDir())
+		writer = journal.Writer(writer)
+	}
+
+	fset := token.NewFileSet()
+	ctx := &build.Default
+	specCtx := ctx
+	if overlay != nil {
+		specCtx = buildutil.OverlayContext(ctx, overlay)
+	}
+	spec, err := filespec.New(specCtx, args[:1])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	for _, warning := range spec.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", warning)
+	}
+	if len(spec.Packages) != 1 {
+		fmt.Fprintf(os.Stderr, "%v must name a single package\n", args[0])
+		return 1
+	}
+	var from string
+	for path := range spec.Packages {
+		from = path
+	}
+	to := strings.TrimSuffix(args[1], "/")
+
+	// The subpackages are moved along with the package.
+	subs, err := filespec.New(specCtx, []string{from + "/..."})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	subs.Packages[from] = true
+
+	if verbose {
+		log.Print("Scanning workspace for importers...")
+	}
+	_, rev, errors := workspace.Build(ctx, spec.Dir, configs, overlay)
+	if len(errors) > 0 {
+		// With a large workspace, errors are inevitable.
+		// Report them but proceed.
+		fmt.Fprintf(os.Stderr, "While scanning Go workspace:\n")
+		for path, err := range errors {
+			fmt.Fprintf(os.Stderr, "Package %q: %s.\n", path, err)
+		}
+	}
+
+	// Enumerate the set of potentially affected packages.
+	affectedPackages := map[string]bool{}
+	for pkg := range subs.Packages {
+		for path := range rev.Search(pkg) {
+			affectedPackages[path] = true
+		}
+	}
+
+	loadConf := &load.Config{Fset: fset, Dir: spec.Dir, Overlay: overlay}
+	if verbose {
+		loadConf.Logf = log.Printf
+	}
+	progs, err := load.PackagesAll(loadConf, configs, affectedPackages)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	for _, prog := range progs {
+		snapshot.Add(prog.Hashes)
+	}
+
+	// Build configurations excluding the moved package are skipped.
+	loaded := progs[:0]
+	for _, prog := range progs {
+		if info := prog.Package(from); info != nil && len(info.Files) > 0 {
+			loaded = append(loaded, prog)
+		} else if verbose {
+			log.Printf("skip build configuration %v: package %v excluded by build constraints", prog.Build, from)
+		}
+	}
+	progs = loaded
+	if len(progs) == 0 {
+		fmt.Fprintf(os.Stderr, "package %v has not been loaded\n", from)
+		return 1
+	}
+	info := progs[0].Package(from)
+	pos := progs[0].Fset.PositionFor(info.Files[0].Name.Pos(), false)
+	toDir, err := filespec.MoveDir(filepath.Dir(pos.Filename), from, to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if verbose {
+		log.Printf("move %v -> %v (%v)\n", from, to, toDir)
+	}
+
+	// The move must be valid in every build configuration. Check all
+	// configurations before updating any program.
+	movers := make([]*renamer.Mover, len(progs))
+	for i, prog := range progs {
+		m := renamer.NewMover(prog, from, to, toDir)
+		m.AddAllPackages(prog.InitialPackages()...)
+		m.Protect(filespec.ProtectGenerated)
+		m.Protect(filespec.ProtectVendored)
+		movers[i] = m
+
+		if err := m.Check(); err != nil {
+			err = cmdutil.ReportConflicts(err)
+			if len(progs) > 1 {
+				err = fmt.Errorf("%v (build configuration %v)", err, prog.Build)
+			}
+			fmt.Fprintln(os.Stderr, "moving failed with: ", err)
+			return 1
+		}
+	}
+
+	reason := fmt.Sprintf("package %v moved to %v", from, to)
+	moves := map[string]string{}
+	for i, m := range movers {
+		files, err := m.Update()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "moving failed with: ", err)
+			return 1
+		}
+		cmdutil.RecordEdits(edits, progs[i].Fset, m.Edits(), reason)
+		for old, moved := range m.Files() {
+			moves[old] = moved
+		}
+		if verbose {
+			for file := range files {
+				log.Println("updated: ", file.Name())
+			}
+		}
+	}
+	if journal != nil {
+		journal.AddRename(pos, from, to)
+	}
+
+	// splice the changes into the original files and move them
+	changed, err := edits.Apply(overlay, snapshot)
+	if err != nil {
+		cmdutil.ReportWriteError(err)
+		return 1
+	}
+	olds := make([]string, 0, len(moves))
+	for old := range moves {
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+	for _, old := range olds {
+		if err := changed.Move(overlay, old, moves[old]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := modes.Move(old, moves[old]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	// write changed files
+	if verbose {
+		for _, file := range changed.Files() {
+			log.Println("update file: ", file)
+		}
+	}
+	if err := write.WriteAll(writer, changed); err != nil {
+		cmdutil.ReportWriteError(err)
+		return 1
+	}
+
+	return 0
+}
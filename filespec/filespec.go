@@ -8,16 +8,40 @@ import (
 	"path/filepath"
 	"strings"
 
-	"golang.org/x/tools/go/loader"
+	"github.com/urso/gotools/load"
+	"github.com/urso/gotools/workspace"
 )
 
 type Spec struct {
 	Files    map[string][]string
 	Packages map[string]bool
+
+	// Dir is the root directory of the module the packages have been
+	// resolved in. Dir is empty if the packages are located in $GOPATH.
+	Dir string
+
+	// IncludeGenerated includes generated files when iterating the files
+	// of the packages. Generated files are skipped by default.
+	IncludeGenerated bool
+
+	// Changes restricts reports and rewrites to identifiers declared in the
+	// changed lines. If nil, all lines are considered changed. See Restrict.
+	Changes Changes
+
+	// Skip excludes the packages and files matching any of the patterns.
+	// See Exclude for the pattern syntax.
+	Skip Patterns
+
+	// Warnings lists the problems found while resolving the arguments that
+	// do not prevent processing the remaining packages, like patterns
+	// matching no packages.
+	Warnings []string
+
+	dirs map[string]string // package directories by import path
 }
 
 type FileInfo struct {
-	Package *loader.PackageInfo
+	Package *load.PackageInfo
 	Path    string
 	File    *ast.File
 }
@@ -25,13 +49,58 @@ type FileInfo struct {
 func New(ctx *build.Context, args []string) (*Spec, error) {
 	files := map[string]map[string]bool{}
 	packages := map[string]bool{}
+	var warnings []string
+
+	// module enclosing the current working directory, used to resolve
+	// import paths
+	cwdModule, err := findModule(".")
+	if err != nil {
+		return nil, err
+	}
+	ws, err := workspace.Find(".")
+	if err != nil {
+		return nil, err
+	}
+	if ws != nil && ws.File != "" {
+		cwdModule = cwdModule.withWorkspace(ws)
+	}
+
+	dir := ""
+	dirs := map[string]string{}
+	dirPkgName := func(path string) (string, error) {
+		if isVendoredDir(path) {
+			return "", fmt.Errorf("package '%v' is vendored; vendored packages are read-only", path)
+		}
+
+		pkgname, mod, err := dirPkgName(ctx, path)
+		if err == nil && mod != nil && dir == "" {
+			dir = mod.Dir
+		}
+		if err == nil {
+			dirs[pkgname], _ = filepath.Abs(path)
+		}
+		return pkgname, err
+	}
 
 	// collect files and packages to and type check from list of unnamed args
 	for _, arg := range args {
 		switch {
 		case strings.HasSuffix(arg, "./...") && isDir(arg[:len(arg)-4]):
-			for _, dirname := range allPackagesInFS(ctx, arg) {
-				pkgname, err := dirPkgName(ctx, dirname)
+			root := arg[:len(arg)-4]
+			mod, err := findModule(root)
+			if err != nil {
+				return nil, err
+			}
+
+			var dirnames []string
+			if mod != nil {
+				dirnames = packageDirs(root)
+			} else {
+				dirnames = allPackagesInFS(ctx, arg)
+			}
+
+			for _, dirname := range dirnames {
+				pkgname, err := dirPkgName(dirname)
 				if err != nil {
 					return nil, err
 				}
@@ -39,20 +108,19 @@ func New(ctx *build.Context, args []string) (*Spec, error) {
 			}
 
 		case isDir(arg):
-			pkgname, err := dirPkgName(ctx, arg)
+			pkgname, err := dirPkgName(arg)
 			if err != nil {
 				return nil, err
 			}
 			packages[pkgname] = true
 
-		case exists(arg):
+		case fileExists(ctx, arg):
 			path, err := filepath.Abs(arg)
 			if err != nil {
 				return nil, err
 			}
 
-			dir := filepath.Dir(path)
-			pkgname, err := dirPkgName(ctx, dir)
+			pkgname, err := dirPkgName(filepath.Dir(path))
 			if err != nil {
 				return nil, err
 			}
@@ -65,6 +133,24 @@ func New(ctx *build.Context, args []string) (*Spec, error) {
 			M[path] = true
 
 		default:
+			if cwdModule != nil {
+				if pkgs, ok := cwdModule.matchPackages(arg); ok {
+					if len(pkgs) == 0 {
+						warnings = append(warnings, fmt.Sprintf("%q matched no packages", arg))
+					}
+					for _, pkgname := range pkgs {
+						packages[pkgname] = true
+						if pkgdir, ok := cwdModule.dir(pkgname); ok {
+							dirs[pkgname] = pkgdir
+						}
+					}
+					if dir == "" {
+						dir = cwdModule.Dir
+					}
+					continue
+				}
+			}
+
 			for _, rel := range importPaths(ctx, arg) {
 				abs, err := filepath.Abs(rel)
 				if err != nil {
@@ -73,7 +159,11 @@ func New(ctx *build.Context, args []string) (*Spec, error) {
 
 				GOSRC := ctx.GOPATH + "/src/"
 				if !strings.HasPrefix(abs, GOSRC) {
-					return nil, fmt.Errorf("package '%v' no in $GOPATH", rel)
+					return nil, fmt.Errorf("package '%v' not in a module or $GOPATH", rel)
+				}
+
+				if isVendoredDir(abs) {
+					return nil, fmt.Errorf("package '%v' is vendored; vendored packages are read-only", rel)
 				}
 
 				pkgname := abs[len(GOSRC):]
@@ -99,24 +189,33 @@ func New(ctx *build.Context, args []string) (*Spec, error) {
 		filtered[pkg] = files
 	}
 
-	return &Spec{filtered, packages}, nil
+	return &Spec{
+		Files:    filtered,
+		Packages: packages,
+		Dir:      dir,
+		Warnings: warnings,
+		dirs:     dirs,
+	}, nil
 }
 
 func (s *Spec) IterFiles(
-	prog *loader.Program,
-	fn func(*loader.PackageInfo, *ast.File) error,
+	prog *load.Program,
+	fn func(*load.PackageInfo, *ast.File) error,
 ) error {
 	fset := prog.Fset
 	for pkg, info := range prog.AllPackages {
 		name := pkg.Path()
-		if !s.Packages[name] {
+		if !s.Packages[name] || s.Skip.Match(name) {
 			continue
 		}
 
 		filter := createFilter(s.Files[name])
 		for _, file := range info.Files {
 			path := fset.File(file.Name.NamePos).Name()
-			if !filter(path) {
+			if !filter(path) || s.Skip.MatchFile(path) {
+				continue
+			}
+			if !s.IncludeGenerated && IsGenerated(file) {
 				continue
 			}
 
@@ -128,10 +227,10 @@ func (s *Spec) IterFiles(
 	return nil
 }
 
-func (s *Spec) CollectFiles(prog *loader.Program) []FileInfo {
+func (s *Spec) CollectFiles(prog *load.Program) []FileInfo {
 	fset := prog.Fset
 	var fileInfos []FileInfo
-	s.IterFiles(prog, func(info *loader.PackageInfo, file *ast.File) error {
+	s.IterFiles(prog, func(info *load.PackageInfo, file *ast.File) error {
 		path := fset.File(file.Name.NamePos).Name()
 		fileInfos = append(fileInfos, FileInfo{
 			Package: info,
@@ -170,17 +269,44 @@ func exists(filename string) bool {
 	return err == nil
 }
 
-func dirPkgName(ctx *build.Context, path string) (string, error) {
+// fileExists is like exists, but also finds files only present in an
+// overlay installed via ctx.OpenFile (see buildutil.OverlayContext).
+func fileExists(ctx *build.Context, filename string) bool {
+	if ctx.OpenFile != nil {
+		if abs, err := filepath.Abs(filename); err == nil {
+			if f, err := ctx.OpenFile(abs); err == nil {
+				f.Close()
+				return true
+			}
+		}
+	}
+	return exists(filename)
+}
+
+// dirPkgName returns the import path of the package in directory path. The
+// enclosing go.mod file takes precedence over $GOPATH. If the package has
+// been resolved via go.mod, the module is returned as well.
+func dirPkgName(ctx *build.Context, path string) (string, *module, error) {
 	abs, err := filepath.Abs(path)
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+
+	mod, err := findModule(abs)
+	if err != nil {
+		return "", nil, err
+	}
+	if mod != nil {
+		if pkgname, ok := mod.importPath(abs); ok {
+			return pkgname, mod, nil
+		}
 	}
 
 	GOSRC := ctx.GOPATH + "/src/"
 	if !strings.HasPrefix(abs, GOSRC) {
-		return "", fmt.Errorf("package '%v' no in $GOPATH", path)
+		return "", nil, fmt.Errorf("package '%v' not in a module or $GOPATH", path)
 	}
 
 	pkgname := abs[len(GOSRC):]
-	return pkgname, nil
+	return pkgname, nil, nil
 }
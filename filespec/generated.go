@@ -0,0 +1,128 @@
+package filespec
+
+import (
+	"fmt"
+	"go/ast"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Generated describes a generated Go file, as declared by the standard
+// '// Code generated ... DO NOT EDIT.' header.
+type Generated struct {
+	Filename string
+
+	// Generator is the command generating the file (e.g. protoc-gen-go,
+	// "stringer -type=Pill"), if named by the header.
+	Generator string
+
+	// Source is the file the generated file is derived from (e.g. a .proto
+	// or .y file), if named by the header.
+	Source string
+}
+
+var generatedRE = regexp.MustCompile(`^// Code generated (.*)DO NOT EDIT\.$`)
+
+var sourceRE = regexp.MustCompile(`^//\s*(?i:source):\s*(\S+)`)
+
+// ParseGenerated checks the header of file for the generated code marker.
+// ParseGenerated returns nil if file has not been generated.
+func ParseGenerated(filename string, file *ast.File) *Generated {
+	var g *Generated
+	for _, group := range file.Comments {
+		if group.Pos() > file.Package {
+			break
+		}
+
+		for _, c := range group.List {
+			if g == nil {
+				if m := generatedRE.FindStringSubmatch(c.Text); m != nil {
+					g = &Generated{
+						Filename:  filename,
+						Generator: parseGenerator(m[1]),
+					}
+				}
+				continue
+			}
+
+			if m := sourceRE.FindStringSubmatch(c.Text); m != nil && g.Source == "" {
+				g.Source = m[1]
+			}
+		}
+	}
+
+	if g != nil && g.Source == "" {
+		g.Source = generatorSource(g.Generator)
+	}
+	return g
+}
+
+// IsGenerated checks if file has been generated.
+func IsGenerated(file *ast.File) bool {
+	return ParseGenerated("", file) != nil
+}
+
+// ProtectGenerated returns an error if file has been generated. The error
+// names the generator and source file to change instead, if known.
+// ProtectGenerated can be passed to (*renamer.Renamer).Protect.
+func ProtectGenerated(filename string, file *ast.File) error {
+	if g := ParseGenerated(filename, file); g != nil {
+		return g
+	}
+	return nil
+}
+
+// Error describes the generated file when trying to modify it.
+func (g *Generated) Error() string {
+	switch {
+	case g.Generator != "" && g.Source != "":
+		return fmt.Sprintf("%v is generated by %v from %v; change %v instead",
+			g.Filename, g.Generator, g.Source, g.Source)
+	case g.Source != "":
+		return fmt.Sprintf("%v is generated from %v; change %v instead",
+			g.Filename, g.Source, g.Source)
+	case g.Generator != "":
+		return fmt.Sprintf("%v is generated by %v; change the generator input instead",
+			g.Filename, g.Generator)
+	default:
+		return fmt.Sprintf("%v is a generated file", g.Filename)
+	}
+}
+
+// parseGenerator extracts the generator command from the text between
+// 'Code generated' and 'DO NOT EDIT.'. e.g.:
+//
+//	by protoc-gen-go.
+//	by "stringer -type=Pill";
+//	by goyacc -o parser.go parser.y.
+func parseGenerator(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimRight(s, ".;,")
+	s = strings.TrimPrefix(s, "by ")
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	return strings.TrimSpace(s)
+}
+
+// generatorSource returns the last non-Go input file passed to the
+// generator command.
+func generatorSource(generator string) string {
+	fields := strings.Fields(generator)
+	if len(fields) < 2 {
+		return ""
+	}
+
+	source := ""
+	for _, arg := range fields[1:] {
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if ext := filepath.Ext(arg); ext != "" && ext != ".go" {
+			source = arg
+		}
+	}
+	return source
+}
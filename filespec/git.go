@@ -0,0 +1,184 @@
+package filespec
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/build"
+	"go/token"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Changes maps absolute file names to the lines changed in the file.
+type Changes map[string][]LineRange
+
+// LineRange is a range of lines, including Start and End.
+type LineRange struct {
+	Start, End int
+}
+
+// GitChanges returns the Go files in the git repository enclosing dir,
+// that differ from the revision rev. If staged is set, only changes added to
+// the index are considered. If rev is empty, the working tree is compared to
+// the index, or the index is compared to HEAD if staged is set.
+//
+// Files not tracked by git yet are treated as changed entirely, unless
+// staged is set.
+func GitChanges(dir, rev string, staged bool) (Changes, error) {
+	out, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root := strings.TrimSpace(string(out))
+
+	args := []string{"diff", "--no-color", "--no-ext-diff", "--unified=0", "--diff-filter=AMR",
+		"--src-prefix=a/", "--dst-prefix=b/"}
+	if staged {
+		args = append(args, "--cached")
+	}
+	if rev != "" {
+		args = append(args, rev)
+	}
+	args = append(args, "--", "*.go")
+
+	out, err = git(root, args...)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := parseDiff(root, out)
+	if err != nil {
+		return nil, err
+	}
+
+	if !staged {
+		out, err = git(root, "ls-files", "-z", "--others", "--exclude-standard", "--", "*.go")
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range strings.Split(string(out), "\x00") {
+			if name != "" {
+				changes[filepath.Join(root, filepath.FromSlash(name))] = []LineRange{{1, math.MaxInt32}}
+			}
+		}
+	}
+	return changes, nil
+}
+
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %v: %v", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %v: %v", args[0], err)
+	}
+	return out, nil
+}
+
+// parseDiff collects the lines added by a unified diff without context
+// lines.
+func parseDiff(root string, diff []byte) (Changes, error) {
+	changes := Changes{}
+	file := ""
+
+	s := bufio.NewScanner(bytes.NewReader(diff))
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			name := strings.TrimPrefix(line, "+++ ")
+			if strings.HasPrefix(name, `"`) {
+				unquoted, err := strconv.Unquote(name)
+				if err != nil {
+					return nil, fmt.Errorf("invalid file name in diff: %v", name)
+				}
+				name = unquoted
+			}
+			file = ""
+			if name != "/dev/null" {
+				file = filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(name, "b/")))
+				changes[file] = nil
+			}
+
+		case strings.HasPrefix(line, "@@ ") && file != "":
+			// @@ -start[,count] +start[,count] @@
+			fields := strings.Fields(line)
+			if len(fields) < 3 || !strings.HasPrefix(fields[2], "+") {
+				return nil, fmt.Errorf("invalid hunk header in diff: %v", line)
+			}
+
+			start, count, err := parseHunkRange(fields[2][1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid hunk header in diff: %v", line)
+			}
+			if count > 0 {
+				changes[file] = append(changes[file], LineRange{start, start + count - 1})
+			}
+		}
+	}
+	return changes, s.Err()
+}
+
+func parseHunkRange(s string) (start, count int, err error) {
+	count = 1
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		if count, err = strconv.Atoi(s[i+1:]); err != nil {
+			return 0, 0, err
+		}
+		s = s[:i]
+	}
+	start, err = strconv.Atoi(s)
+	return start, count, err
+}
+
+// Restrict limits the spec to the files in changes. Packages without any
+// changed file are removed. Changed reports the lines changed in the
+// remaining files.
+func (s *Spec) Restrict(ctx *build.Context, changes Changes) {
+	files := map[string][]string{}
+	packages := map[string]bool{}
+	for filename := range changes {
+		if !fileExists(ctx, filename) {
+			continue
+		}
+
+		pkgname, _, err := dirPkgName(ctx, filepath.Dir(filename))
+		if err != nil || !s.Packages[pkgname] {
+			continue
+		}
+		if fs := s.Files[pkgname]; len(fs) > 0 && !createFilter(fs)(filename) {
+			continue
+		}
+
+		packages[pkgname] = true
+		files[pkgname] = append(files[pkgname], filename)
+	}
+
+	s.Files = files
+	s.Packages = packages
+	s.Changes = changes
+}
+
+// Changed checks if the line at pos has been changed. If the spec has not
+// been restricted to a set of changes, all lines are considered changed.
+func (s *Spec) Changed(pos token.Position) bool {
+	if s.Changes == nil {
+		return true
+	}
+	for _, r := range s.Changes[pos.Filename] {
+		if r.Start <= pos.Line && pos.Line <= r.End {
+			return true
+		}
+	}
+	return false
+}
@@ -122,10 +122,11 @@ func matchPackagesInFS(ctx *build.Context, pattern string) []string {
 			path = filepath.Clean(path)
 		}
 
-		// Avoid .foo, _foo, and testdata directory trees, but do not avoid "." or "..".
+		// Avoid .foo, _foo, testdata and vendor directory trees, but do not
+		// avoid "." or "..". Vendored packages are read-only dependencies.
 		_, elem := filepath.Split(path)
 		dot := strings.HasPrefix(elem, ".") && elem != "." && elem != ".."
-		if dot || strings.HasPrefix(elem, "_") || elem == "testdata" {
+		if dot || strings.HasPrefix(elem, "_") || elem == "testdata" || elem == "vendor" {
 			return filepath.SkipDir
 		}
 
@@ -228,9 +229,10 @@ func matchPackages(ctx *build.Context, pattern string) []string {
 				return nil
 			}
 
-			// Avoid .foo, _foo, and testdata directory trees.
+			// Avoid .foo, _foo, testdata and vendor directory trees.
 			_, elem := filepath.Split(path)
-			if strings.HasPrefix(elem, ".") || strings.HasPrefix(elem, "_") || elem == "testdata" {
+			if strings.HasPrefix(elem, ".") || strings.HasPrefix(elem, "_") ||
+				elem == "testdata" || elem == "vendor" {
 				return filepath.SkipDir
 			}
 
@@ -0,0 +1,219 @@
+package filespec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+
+	"github.com/urso/gotools/workspace"
+)
+
+// module describes the Go module enclosing a directory, as read from its
+// go.mod file.
+type module struct {
+	Path string // module path declared by the module directive
+	Dir  string // directory containing the go.mod file
+
+	// roots maps module paths to local directories. It contains the main
+	// module itself and all replace directives pointing to a directory.
+	// Sorted by length of dir, longest first.
+	roots []moduleRoot
+}
+
+type moduleRoot struct {
+	path string
+	dir  string
+}
+
+// findModule searches dir and its parent directories for a go.mod file.
+// findModule returns nil if dir is not part of a module.
+func findModule(dir string) (*module, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	gomod := workspace.FindFile(dir, "go.mod")
+	if gomod == "" {
+		return nil, nil
+	}
+	return readModule(gomod)
+}
+
+func readModule(gomod string) (*module, error) {
+	data, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := modfile.Parse(gomod, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.Module == nil {
+		return nil, fmt.Errorf("%v: missing module directive", gomod)
+	}
+
+	m := &module{
+		Path: f.Module.Mod.Path,
+		Dir:  filepath.Dir(gomod),
+	}
+	m.roots = append(m.roots, moduleRoot{m.Path, m.Dir})
+	for _, r := range f.Replace {
+		// Only replacements pointing to a local directory can be resolved
+		// without consulting the module cache.
+		if r.New.Version != "" || !modfile.IsDirectoryPath(r.New.Path) {
+			continue
+		}
+
+		dir := filepath.FromSlash(r.New.Path)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(m.Dir, dir)
+		}
+		m.roots = append(m.roots, moduleRoot{r.Old.Path, filepath.Clean(dir)})
+	}
+
+	sort.SliceStable(m.roots, func(i, j int) bool {
+		return len(m.roots[i].dir) > len(m.roots[j].dir)
+	})
+	return m, nil
+}
+
+// withWorkspace adds the modules of a go.work workspace to the module
+// roots, such that packages in sibling modules can be resolved. If m is nil,
+// the workspace directory is used as module directory.
+func (m *module) withWorkspace(ws *workspace.Workspace) *module {
+	if m == nil {
+		m = &module{Dir: filepath.Dir(ws.File)}
+	}
+
+	known := map[string]bool{}
+	for _, root := range m.roots {
+		known[root.path] = true
+	}
+	for _, wm := range ws.Modules {
+		if !known[wm.Path] {
+			m.roots = append(m.roots, moduleRoot{wm.Path, wm.Dir})
+		}
+	}
+
+	sort.SliceStable(m.roots, func(i, j int) bool {
+		return len(m.roots[i].dir) > len(m.roots[j].dir)
+	})
+	return m
+}
+
+// importPath returns the import path of the package in directory dir. Dir
+// must be located in the module itself or in a locally replaced module.
+func (m *module) importPath(dir string) (string, bool) {
+	for _, root := range m.roots {
+		if rel, ok := workspace.RelPath(root.dir, dir); ok {
+			if rel == "." {
+				return root.path, true
+			}
+			return path.Join(root.path, filepath.ToSlash(rel)), true
+		}
+	}
+	return "", false
+}
+
+// dir returns the directory of the package with the given import path. The
+// import path must be relative to the module path or the path of a locally
+// replaced module.
+func (m *module) dir(importPath string) (string, bool) {
+	best := -1
+	for i, root := range m.roots {
+		if !hasPathPrefix(importPath, root.path) {
+			continue
+		}
+		if best < 0 || len(root.path) > len(m.roots[best].path) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+
+	root := m.roots[best]
+	rel := strings.TrimPrefix(importPath[len(root.path):], "/")
+	return filepath.Join(root.dir, filepath.FromSlash(rel)), true
+}
+
+// matchPackages returns the import paths of all packages in the module
+// matching pattern. Pattern is an import path possibly containing "...".
+// The second result is false if pattern does not refer to the module or
+// any of its local replacements.
+func (m *module) matchPackages(pattern string) ([]string, bool) {
+	prefix := pattern
+	if i := strings.Index(pattern, "..."); i >= 0 {
+		prefix = strings.TrimSuffix(pattern[:i], "/")
+	}
+
+	dir, ok := m.dir(prefix)
+	if !ok {
+		return nil, false
+	}
+	if !strings.Contains(pattern, "...") {
+		if !isDir(dir) {
+			return nil, true
+		}
+		return []string{pattern}, true
+	}
+
+	match := matchPattern(nil, pattern)
+	var pkgs []string
+	for _, d := range packageDirs(dir) {
+		if p, ok := m.importPath(d); ok && match(p) {
+			pkgs = append(pkgs, p)
+		}
+	}
+	return pkgs, true
+}
+
+// packageDirs returns all directories under root containing Go packages.
+// Nested modules are not part of the module being walked and are skipped.
+// Vendored packages are read-only dependencies and skipped as well.
+func packageDirs(root string) []string {
+	var dirs []string
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+
+		if path != root {
+			_, elem := filepath.Split(path)
+			if strings.HasPrefix(elem, ".") || strings.HasPrefix(elem, "_") ||
+				elem == "testdata" || elem == "vendor" {
+				return filepath.SkipDir
+			}
+			if exists(filepath.Join(path, "go.mod")) {
+				return filepath.SkipDir
+			}
+		}
+
+		if hasGoFiles(path) {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	return dirs
+}
+
+func hasGoFiles(dir string) bool {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".go") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package filespec
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/urso/gotools/workspace"
+)
+
+// MoveDir returns the directory the package with import path from, located
+// in fromDir, is moved to when changing its import path to to. Within
+// modules, to must be located in the module of the package, a locally
+// replaced module or another module of the workspace. Outside of modules,
+// the package is moved within its $GOPATH source directory.
+func MoveDir(fromDir, from, to string) (string, error) {
+	fromDir, err := filepath.Abs(fromDir)
+	if err != nil {
+		return "", err
+	}
+
+	mod, err := findModule(fromDir)
+	if err != nil {
+		return "", err
+	}
+	if mod == nil {
+		// $GOPATH/src/<from>
+		src := strings.TrimSuffix(fromDir, filepath.FromSlash(from))
+		if src == fromDir {
+			return "", fmt.Errorf("package '%v' not in a module or $GOPATH", from)
+		}
+		return filepath.Join(src, filepath.FromSlash(to)), nil
+	}
+
+	ws, err := workspace.Find(fromDir)
+	if err != nil {
+		return "", err
+	}
+	if ws != nil && ws.File != "" {
+		mod = mod.withWorkspace(ws)
+	}
+	dir, ok := mod.dir(to)
+	if !ok {
+		return "", fmt.Errorf("import path '%v' is not located in module %v or its local replacements", to, mod.Path)
+	}
+	return dir, nil
+}
@@ -0,0 +1,203 @@
+package filespec
+
+import (
+	"bufio"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/urso/gotools/workspace"
+)
+
+// Patterns is a list of patterns selecting packages and files to skip.
+// Patterns implements flag.Value, such that the flag can be repeated on the
+// command line.
+//
+// Files are matched by their path relative to the root of the enclosing
+// module and by their import path, that is the import path of the package
+// directory joined with the file name. A pattern without a slash matches any
+// element of these paths, e.g. 'vendor' or '*_string.go'. Other patterns
+// match a path from its start, e.g. 'third_party/*' or
+// 'example.com/mod/internal/legacy/...'. A pattern also matches everything
+// below the directories it matches.
+// Patterns use the syntax of path.Match, '...' matches any string.
+type Patterns []string
+
+func (ps *Patterns) String() string {
+	if ps == nil {
+		return ""
+	}
+	return strings.Join(*ps, " ")
+}
+
+func (ps *Patterns) Set(s string) error {
+	if _, err := path.Match(s, ""); err != nil {
+		return fmt.Errorf("invalid pattern '%v': %v", s, err)
+	}
+	*ps = append(*ps, s)
+	return nil
+}
+
+// Match checks if any pattern matches the import path or file path name.
+func (ps Patterns) Match(name string) bool {
+	name = filepath.ToSlash(name)
+	for _, pattern := range ps {
+		if matchSkip(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchFile checks if any pattern matches the file or directory filename.
+// The absolute filename itself is never matched, such that patterns do not
+// match the directories the module is located in.
+func (ps Patterns) MatchFile(filename string) bool {
+	if len(ps) == 0 {
+		return false
+	}
+	for _, name := range skipNames(filename) {
+		if ps.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipNames returns the paths of filename patterns are matched against: the
+// path relative to the enclosing module and the import path. Outside of a
+// module, the import path is derived from $GOPATH.
+func skipNames(filename string) []string {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil
+	}
+
+	mod, err := findModule(abs)
+	if err != nil {
+		return nil
+	}
+	if mod != nil {
+		var names []string
+		if rel, ok := workspace.RelPath(mod.Dir, abs); ok && rel != "." {
+			names = append(names, rel)
+		}
+		if importPath, ok := mod.importPath(abs); ok {
+			names = append(names, importPath)
+		}
+		return names
+	}
+
+	for _, gopath := range filepath.SplitList(build.Default.GOPATH) {
+		if rel, ok := workspace.RelPath(filepath.Join(gopath, "src"), abs); ok && rel != "." {
+			return []string{rel}
+		}
+	}
+	return nil
+}
+
+// Exclude removes all packages and files matching any of patterns from the
+// spec. The patterns are added to Skip.
+func (s *Spec) Exclude(patterns ...string) {
+	s.Skip = append(s.Skip, patterns...)
+
+	for pkg := range s.Packages {
+		if s.Skip.Match(pkg) {
+			delete(s.Packages, pkg)
+			delete(s.Files, pkg)
+			continue
+		}
+		if dir, ok := s.dirs[pkg]; ok && s.Skip.MatchFile(dir) {
+			delete(s.Packages, pkg)
+			delete(s.Files, pkg)
+			continue
+		}
+
+		files := s.Files[pkg]
+		if len(files) == 0 {
+			continue
+		}
+
+		var kept []string
+		for _, file := range files {
+			if !s.Skip.MatchFile(file) {
+				kept = append(kept, file)
+			}
+		}
+		if len(kept) == 0 {
+			// all files selected have been excluded
+			delete(s.Packages, pkg)
+			delete(s.Files, pkg)
+		} else {
+			s.Files[pkg] = kept
+		}
+	}
+}
+
+// ReadTargets reads the arguments to pass to New from a file, one per line.
+// Empty lines and lines starting with '#' are ignored. If filename is '-',
+// the targets are read from stdin.
+func ReadTargets(filename string) ([]string, error) {
+	var in io.Reader
+	if filename == "-" {
+		in = os.Stdin
+	} else {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var targets []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		targets = append(targets, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// matchSkip checks if pattern matches name or one of its parent
+// directories.
+func matchSkip(pattern, name string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	if pattern == "" {
+		return false
+	}
+
+	if !strings.Contains(pattern, "/") {
+		for _, elem := range strings.Split(name, "/") {
+			if matchGlob(pattern, elem) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' && i > 0 && matchGlob(pattern, name[:i]) {
+			return true
+		}
+	}
+	return matchGlob(pattern, name)
+}
+
+func matchGlob(pattern, name string) bool {
+	if strings.Contains(pattern, "...") {
+		return matchPattern(nil, pattern)(name)
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
@@ -0,0 +1,49 @@
+package filespec
+
+import (
+	"fmt"
+	"go/ast"
+	"path/filepath"
+	"strings"
+
+	"github.com/urso/gotools/workspace"
+)
+
+// IsVendored checks if the file filename is part of a vendored package.
+// Only vendor directories within the enclosing module are considered, if
+// filename is part of a module.
+func IsVendored(filename string) bool {
+	return isVendoredDir(filepath.Dir(filename))
+}
+
+// ProtectVendored returns an error if the file is part of a vendored
+// package. Vendored packages are read-only copies of dependencies.
+// ProtectVendored can be passed to (*renamer.Renamer).Protect.
+func ProtectVendored(filename string, _ *ast.File) error {
+	if IsVendored(filename) {
+		return fmt.Errorf("%v is part of a vendored package; vendored dependencies are read-only", filename)
+	}
+	return nil
+}
+
+// isVendoredDir checks if dir is a vendor directory or located in one.
+func isVendoredDir(dir string) bool {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+
+	path := abs
+	if mod, err := findModule(abs); err == nil && mod != nil {
+		if rel, ok := workspace.RelPath(mod.Dir, abs); ok {
+			path = rel
+		}
+	}
+
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == "vendor" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package cmdutil
+
+import (
+	"fmt"
+
+	"github.com/urso/gotools/write"
+)
+
+// Apply applies a patch file created with -patch, after checking that none
+// of the patched files has been changed since. Args names the patch file.
+// Usage is called if args are invalid. If journal is set, the run is
+// recorded for undo. Apply returns the exit code of the command.
+func Apply(args []string, usage func(), journal bool) int {
+	if len(args) != 1 {
+		usage()
+		return 2
+	}
+
+	changes, modes, err := write.ReadPatch(args[0], WorkspaceRoot())
+	if err != nil {
+		ReportWriteError(err)
+		return 1
+	}
+
+	writer := write.NewFileWriter(modes)
+	if journal {
+		writer = write.NewJournal(JournalDir()).Writer(writer)
+	}
+	if err := write.WriteAll(writer, changes); err != nil {
+		ReportWriteError(err)
+		return 1
+	}
+
+	for _, file := range changes.Files() {
+		fmt.Println("patched: ", file)
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+// Package cmdutil implements the parts shared by the refactoring commands:
+// recording edits, reporting conflicts and write errors, and the undo and
+// apply subcommands.
+package cmdutil
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+	"os"
+
+	"github.com/urso/gotools/renamer"
+	"github.com/urso/gotools/write"
+)
+
+// RecordEdits adds the changes of a renaming or move to edits.
+func RecordEdits(edits write.EditSet, fset *token.FileSet, changes []renamer.Edit, reason string) {
+	for _, e := range changes {
+		// Edits apply to the physical file, ignoring //line directives.
+		pos := fset.PositionFor(e.Pos, false)
+		edits.Add(write.Edit{
+			Filename: pos.Filename,
+			Offset:   pos.Offset,
+			End:      pos.Offset + int(e.End-e.Pos),
+			NewText:  e.Text,
+			OldName:  e.From,
+			NewName:  e.To,
+			Kind:     e.Kind,
+			Reason:   reason,
+		})
+	}
+}
+
+// ReportConflicts prints the conflicts a renaming has been rejected with.
+// The error returned summarizes err for the final failure message, such
+// that the conflicts are not printed twice.
+func ReportConflicts(err error) error {
+	conflicts, ok := err.(*renamer.ConflictError)
+	if !ok {
+		return err
+	}
+	for _, c := range conflicts.Conflicts {
+		fmt.Fprintln(os.Stderr, c)
+	}
+	if len(conflicts.Conflicts) == 1 {
+		return errors.New("1 conflict detected")
+	}
+	return fmt.Errorf("%v conflicts detected", len(conflicts.Conflicts))
+}
+
+// ReportWriteError prints the error returned by a writer, listing the files
+// that could not be written or restored.
+func ReportWriteError(err error) {
+	applyErr, ok := err.(*write.ApplyError)
+	if !ok {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "failed to write files:")
+	for _, f := range applyErr.Failed {
+		fmt.Fprintf(os.Stderr, "    %v\n", f.Error())
+	}
+	if len(applyErr.RestoreFailed) > 0 {
+		fmt.Fprintln(os.Stderr, "failed to restore original contents:")
+		for _, f := range applyErr.RestoreFailed {
+			fmt.Fprintf(os.Stderr, "    %v\n", f.Error())
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package cmdutil
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/urso/gotools/workspace"
+	"github.com/urso/gotools/write"
+)
+
+// WorkspaceRoot returns the root directory of the workspace enclosing the
+// current working directory.
+func WorkspaceRoot() string {
+	root, err := os.Getwd()
+	if err != nil {
+		root = "."
+	}
+	if ws, err := workspace.Find(root); err == nil && ws != nil {
+		root = ws.Root()
+	}
+	return root
+}
+
+// JournalDir returns the directory undo journals of the workspace are
+// stored in.
+func JournalDir() string {
+	return write.JournalDir(WorkspaceRoot())
+}
+
+// Undo restores the files changed by a previous run. Args optionally names
+// the journal of the run to undo. Usage is called if args are invalid. Undo
+// returns the exit code of the command.
+func Undo(args []string, usage func(), verbose bool) int {
+	if len(args) > 1 {
+		usage()
+		return 2
+	}
+
+	id := ""
+	if len(args) == 1 {
+		id = args[0]
+	}
+
+	j, err := write.Undo(JournalDir(), id)
+	if err != nil {
+		if j != nil {
+			fmt.Fprintf(os.Stderr, "cannot undo run %v\n", j.ID)
+		}
+		ReportWriteError(err)
+		return 1
+	}
+
+	for _, r := range j.Renames {
+		if verbose {
+			fmt.Printf("%v: %v -> %v\n", r.Position, r.To, r.From)
+		}
+	}
+	for _, f := range j.Files {
+		fmt.Println("restored: ", f.Filename)
+	}
+	return 0
+}
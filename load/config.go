@@ -0,0 +1,150 @@
+package load
+
+import (
+	"errors"
+	"fmt"
+	"go/build"
+	"os"
+	"strings"
+)
+
+// BuildConfig selects the GOOS, GOARCH and build tags to load a program
+// with. Empty fields use the defaults of the build system.
+type BuildConfig struct {
+	GOOS   string
+	GOARCH string
+	Tags   []string
+}
+
+// BuildConfigs is a list of build configurations. BuildConfigs implements
+// flag.Value, such that it can be used to parse a list of build
+// configurations from the command line. Configurations are separated by
+// whitespace and have the form '[GOOS/GOARCH][,tag...]', e.g.
+// 'linux/amd64 windows/amd64,integration'.
+type BuildConfigs []BuildConfig
+
+// ParseBuildConfig parses a single build configuration of the form
+// '[GOOS/GOARCH][,tag...]'.
+func ParseBuildConfig(s string) (BuildConfig, error) {
+	var c BuildConfig
+
+	parts := strings.Split(s, ",")
+	if platform := parts[0]; platform != "" {
+		i := strings.IndexByte(platform, '/')
+		if i <= 0 || i == len(platform)-1 || strings.Count(platform, "/") != 1 {
+			return c, fmt.Errorf("invalid build configuration '%v': expected GOOS/GOARCH", s)
+		}
+		c.GOOS, c.GOARCH = platform[:i], platform[i+1:]
+	}
+
+	for _, tag := range parts[1:] {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			c.Tags = append(c.Tags, tag)
+		}
+	}
+	return c, nil
+}
+
+func (c BuildConfig) String() string {
+	s := "default"
+	if c.GOOS != "" || c.GOARCH != "" {
+		s = c.GOOS + "/" + c.GOARCH
+	}
+	if len(c.Tags) > 0 {
+		s += "," + strings.Join(c.Tags, ",")
+	}
+	return s
+}
+
+// apply returns a copy of conf loading the program with the build
+// configuration.
+func (c BuildConfig) apply(conf *Config) *Config {
+	tmp := *conf
+
+	if c.GOOS != "" || c.GOARCH != "" {
+		env := conf.Env
+		if env == nil {
+			env = os.Environ()
+		}
+		tmp.Env = append(append([]string{}, env...), "GOOS="+c.GOOS, "GOARCH="+c.GOARCH)
+	}
+	if len(c.Tags) > 0 {
+		tmp.BuildFlags = append(append([]string{}, conf.BuildFlags...),
+			"-tags="+strings.Join(c.Tags, ","))
+	}
+	return &tmp
+}
+
+// Context returns a copy of ctx matching files with the build
+// configuration.
+func (c BuildConfig) Context(ctx *build.Context) *build.Context {
+	tmp := *ctx
+	if c.GOOS != "" && c.GOARCH != "" && (c.GOOS != ctx.GOOS || c.GOARCH != ctx.GOARCH) {
+		tmp.GOOS, tmp.GOARCH = c.GOOS, c.GOARCH
+		// cgo is disabled by default when cross compiling
+		tmp.CgoEnabled = false
+	}
+	tmp.BuildTags = append(append([]string{}, ctx.BuildTags...), c.Tags...)
+	return &tmp
+}
+
+func (cs *BuildConfigs) String() string {
+	if cs == nil {
+		return ""
+	}
+
+	strs := make([]string, len(*cs))
+	for i, c := range *cs {
+		strs[i] = c.String()
+	}
+	return strings.Join(strs, " ")
+}
+
+func (cs *BuildConfigs) Set(s string) error {
+	for _, field := range strings.Fields(s) {
+		c, err := ParseBuildConfig(field)
+		if err != nil {
+			return err
+		}
+		*cs = append(*cs, c)
+	}
+	return nil
+}
+
+// PackagesAll loads the packages with the given import paths once per build
+// configuration. If no build configuration is given, the packages are
+// loaded with the default configuration only. Build configurations
+// excluding all the packages are skipped. PackagesAll fails if the packages
+// are excluded in every build configuration.
+func PackagesAll(conf *Config, configs []BuildConfig, paths map[string]bool) ([]*Program, error) {
+	if len(configs) == 0 {
+		configs = []BuildConfig{{}}
+	}
+
+	progs := make([]*Program, 0, len(configs))
+	for _, c := range configs {
+		if conf.Logf != nil {
+			conf.Logf("load build configuration: %v", c)
+		}
+
+		prog, err := Packages(c.apply(conf), paths)
+		if err != nil {
+			if len(configs) > 1 && errors.Is(err, errNoInitialPackages) {
+				if conf.Logf != nil {
+					conf.Logf("skip build configuration %v: packages excluded by build constraints", c)
+				}
+				continue
+			}
+			if len(configs) > 1 {
+				err = fmt.Errorf("%v (build configuration %v)", err, c)
+			}
+			return nil, err
+		}
+		prog.Build = c
+		progs = append(progs, prog)
+	}
+	if len(progs) == 0 {
+		return nil, fmt.Errorf("%v in any build configuration", errNoInitialPackages)
+	}
+	return progs, nil
+}
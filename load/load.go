@@ -0,0 +1,578 @@
+// Package load loads and type checks Go programs via go/packages.
+//
+// Unlike go/packages, in-package test files are type checked as part of the
+// package under test, like golang.org/x/tools/go/loader used to do. This
+// way every package path maps to exactly one types.Package, and renaming an
+// object in the package also updates its uses in the test files.
+package load
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// Config configures how a program is loaded.
+type Config struct {
+	Fset *token.FileSet
+
+	// Dir is the directory to run the build system in. Import paths and
+	// patterns are resolved relative to the module in Dir. If empty, the
+	// current working directory is used.
+	Dir string
+
+	// Env and BuildFlags are passed to the build system.
+	Env        []string
+	BuildFlags []string
+
+	// Tests loads the test packages of the initial packages.
+	Tests bool
+
+	// Overlay maps absolute file paths to contents used in place of the
+	// files on disk. See ReadOverlay.
+	Overlay map[string][]byte
+
+	// TypeCheckFuncBodies reports whether function bodies of the package
+	// with the given import path must be type checked. If nil, all function
+	// bodies are type checked.
+	TypeCheckFuncBodies func(path string) bool
+
+	// Logf is used for verbose logging if not nil.
+	Logf func(format string, args ...interface{})
+}
+
+// errNoInitialPackages is returned by Load if all packages matching the
+// patterns are excluded by build constraints.
+var errNoInitialPackages = errors.New("no initial packages were loaded")
+
+// Program is a type checked Go program.
+type Program struct {
+	Fset *token.FileSet
+
+	// Build is the build configuration the program has been loaded with.
+	Build BuildConfig
+
+	// AllPackages contains all packages loaded, including dependencies.
+	AllPackages map[*types.Package]*PackageInfo
+
+	// Hashes maps the names of all files read from disk to the hex encoded
+	// SHA-256 hashes of the contents the program has been parsed from.
+	// Files read from the overlay are not included.
+	Hashes map[string]string
+
+	initial []*PackageInfo
+}
+
+// PackageInfo holds the syntax trees and type information of a single
+// package.
+type PackageInfo struct {
+	Pkg    *types.Package
+	Files  []*ast.File
+	Errors []error // parse, build system and type errors
+	types.Info
+
+	// IgnoredFiles holds the Go files in the package directory excluded by
+	// build constraints, parsed up to the import declarations. The files
+	// are not type checked and might belong to other packages. Only the
+	// packages whose function bodies are type checked record the ignored
+	// files.
+	IgnoredFiles []*ast.File
+
+	path      string
+	name      string
+	files     []string          // compiled Go files
+	testFiles []string          // in-package test files
+	ignored   []string          // Go files excluded by build constraints
+	imports   map[string]string // import path as found in source -> package path
+	forTest   string            // package under test, if external test package
+	fakeC     bool              // cgo has not been applied to files
+	excluded  bool              // all files excluded by build constraints
+	goVersion string
+	sizes     types.Sizes
+
+	checker     *types.Checker
+	state       checkState
+	testChecked bool
+}
+
+type checkState uint8
+
+const (
+	unchecked checkState = iota
+	checking
+	checked
+)
+
+type loader struct {
+	conf     *Config
+	fset     *token.FileSet
+	packages map[string]*PackageInfo
+	order    []*PackageInfo
+	hashes   map[string]string
+}
+
+const loadMode = packages.NeedName |
+	packages.NeedFiles |
+	packages.NeedCompiledGoFiles |
+	packages.NeedImports |
+	packages.NeedDeps |
+	packages.NeedForTest |
+	packages.NeedModule |
+	packages.NeedTypesSizes
+
+// Packages loads the packages with the given import paths, including their
+// tests. Function bodies are type checked for these packages only.
+func Packages(conf *Config, paths map[string]bool) (*Program, error) {
+	tmp := *conf
+	tmp.Tests = true
+	tmp.TypeCheckFuncBodies = func(path string) bool {
+		return paths[path] || paths[strings.TrimSuffix(path, "_test")]
+	}
+
+	var patterns []string
+	for path := range paths {
+		patterns = append(patterns, path)
+	}
+	sort.Strings(patterns)
+	return Load(&tmp, patterns...)
+}
+
+// Load loads and type checks the packages matching patterns and all their
+// dependencies.
+//
+// go/types reports certain "soft" errors that gc does not (Go issue 14596).
+// Load fails only if some package contains "hard" errors.
+func Load(conf *Config, patterns ...string) (*Program, error) {
+	fset := conf.Fset
+	if fset == nil {
+		fset = token.NewFileSet()
+	}
+
+	if conf.Logf != nil {
+		for _, pattern := range patterns {
+			conf.Logf("load package: %v", pattern)
+		}
+	}
+
+	pkgs, err := packages.Load(&packages.Config{
+		Mode:       loadMode,
+		Dir:        conf.Dir,
+		Env:        conf.Env,
+		BuildFlags: conf.BuildFlags,
+		Tests:      conf.Tests,
+		Overlay:    conf.Overlay,
+		Fset:       fset,
+	}, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &loader{
+		conf:     conf,
+		fset:     fset,
+		packages: map[string]*PackageInfo{},
+		hashes:   map[string]string{},
+	}
+	initial := l.collect(pkgs)
+	if len(initial) == 0 {
+		return nil, errNoInitialPackages
+	}
+
+	if conf.Logf != nil {
+		conf.Logf("Do Load and check")
+	}
+	for _, info := range l.order {
+		l.check(info)
+		l.checkTests(info)
+	}
+
+	prog := &Program{
+		Fset:        fset,
+		AllPackages: map[*types.Package]*PackageInfo{},
+		Hashes:      l.hashes,
+		initial:     initial,
+	}
+	for _, info := range l.order {
+		prog.AllPackages[info.Pkg] = info
+	}
+
+	if err := checkErrors(l.order); err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
+
+// InitialPackages returns the packages matching the patterns passed to
+// Load, including external test packages.
+func (prog *Program) InitialPackages() []*PackageInfo {
+	return prog.initial
+}
+
+// Package returns the package with the given package path. Package returns
+// nil if the package has not been loaded.
+func (prog *Program) Package(path string) *PackageInfo {
+	for pkg, info := range prog.AllPackages {
+		if pkg.Path() == path {
+			return info
+		}
+	}
+	return nil
+}
+
+// PathEnclosingInterval returns the PackageInfo and ast.Node that
+// contain source interval [start, end), and all the node's ancestors
+// up to the AST root. It searches all ast.Files of all packages.
+// exact is defined as for astutil.PathEnclosingInterval.
+func (prog *Program) PathEnclosingInterval(start, end token.Pos) (pkg *PackageInfo, path []ast.Node, exact bool) {
+	for _, info := range prog.AllPackages {
+		for _, f := range info.Files {
+			if !tokenFileContainsPos(prog.Fset.File(f.FileStart), start) {
+				continue
+			}
+			if path, exact := astutil.PathEnclosingInterval(f, start, end); path != nil {
+				return info, path, exact
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// collect creates a PackageInfo per package path. Test variants of the
+// initial packages are merged into the package under test. Packages
+// recompiled for testing are replaced by the original package.
+func (l *loader) collect(pkgs []*packages.Package) []*PackageInfo {
+	var variants []*packages.Package
+	packages.Visit(pkgs, nil, func(p *packages.Package) {
+		switch {
+		case isTestMain(p), p.PkgPath == "unsafe":
+		case p.ForTest == "":
+			l.add(p)
+		default:
+			variants = append(variants, p)
+		}
+	})
+
+	for _, p := range variants {
+		switch {
+		case p.PkgPath == p.ForTest:
+			l.addTests(p)
+		case p.PkgPath == p.ForTest+"_test":
+			// The ignored files are recorded by the package under test.
+			info := l.add(p)
+			info.forTest = p.ForTest
+			info.ignored = nil
+		case l.packages[p.PkgPath] == nil:
+			// package has only been loaded as a dependency of some test
+			l.add(p)
+		}
+	}
+
+	// Packages without any files in the current build configuration are
+	// not part of the program.
+	order := l.order[:0]
+	for _, info := range l.order {
+		if len(info.files) == 0 && len(info.testFiles) == 0 && info.excluded {
+			delete(l.packages, info.path)
+			continue
+		}
+		order = append(order, info)
+	}
+	l.order = order
+
+	var initial []*PackageInfo
+	seen := map[*PackageInfo]bool{}
+	for _, p := range pkgs {
+		info := l.packages[p.PkgPath]
+		if info == nil || isTestMain(p) || seen[info] {
+			continue
+		}
+		seen[info] = true
+		initial = append(initial, info)
+	}
+	return initial
+}
+
+func (l *loader) add(p *packages.Package) *PackageInfo {
+	if info := l.packages[p.PkgPath]; info != nil {
+		return info
+	}
+
+	info := &PackageInfo{
+		Info: types.Info{
+			Types:      map[ast.Expr]types.TypeAndValue{},
+			Defs:       map[*ast.Ident]types.Object{},
+			Uses:       map[*ast.Ident]types.Object{},
+			Implicits:  map[ast.Node]types.Object{},
+			Instances:  map[*ast.Ident]types.Instance{},
+			Scopes:     map[ast.Node]*types.Scope{},
+			Selections: map[*ast.SelectorExpr]*types.Selection{},
+		},
+		path:    p.PkgPath,
+		name:    p.Name,
+		imports: map[string]string{},
+		sizes:   p.TypesSizes,
+	}
+	if p.Module != nil && p.Module.GoVersion != "" {
+		info.goVersion = "go" + p.Module.GoVersion
+	}
+	info.files, info.fakeC = compiledFiles(p)
+	info.excluded = len(p.GoFiles) == 0 && len(p.IgnoredFiles) > 0
+	info.ignored = ignoredGoFiles(p, nil)
+	for path, imp := range p.Imports {
+		info.imports[path] = imp.PkgPath
+	}
+	for _, err := range p.Errors {
+		info.Errors = append(info.Errors, err)
+	}
+
+	l.packages[p.PkgPath] = info
+	l.order = append(l.order, info)
+	return info
+}
+
+// addTests merges the in-package test files of the test variant p into the
+// package under test.
+func (l *loader) addTests(p *packages.Package) {
+	info := l.packages[p.PkgPath]
+	if info == nil {
+		// package consists of test files only
+		info = l.add(p)
+		info.testFiles, info.files = info.files, nil
+		return
+	}
+
+	files, _ := compiledFiles(p)
+	known := map[string]bool{}
+	for _, name := range info.files {
+		known[name] = true
+	}
+	for _, name := range files {
+		if !known[name] {
+			info.testFiles = append(info.testFiles, name)
+		}
+	}
+	info.ignored = append(info.ignored, ignoredGoFiles(p, info.ignored)...)
+
+	for path, imp := range p.Imports {
+		if _, exists := info.imports[path]; !exists {
+			info.imports[path] = imp.PkgPath
+		}
+	}
+	for _, err := range p.Errors {
+		info.Errors = append(info.Errors, err)
+	}
+}
+
+// check type checks the non-test files of a package.
+func (l *loader) check(info *PackageInfo) error {
+	switch info.state {
+	case checked:
+		return nil
+	case checking:
+		return fmt.Errorf("import cycle via %q", info.path)
+	}
+	info.state = checking
+
+	bodies := l.conf.TypeCheckFuncBodies
+	conf := &types.Config{
+		IgnoreFuncBodies: bodies != nil && !bodies(info.path),
+		FakeImportC:      info.fakeC,
+		GoVersion:        info.goVersion,
+		Sizes:            info.sizes,
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			return l.importPackage(info, path)
+		}),
+		Error: func(err error) {
+			info.Errors = append(info.Errors, err)
+		},
+	}
+
+	info.Pkg = types.NewPackage(info.path, info.name)
+	info.checker = types.NewChecker(conf, l.fset, info.Pkg, &info.Info)
+	info.Files = l.parseFiles(info, info.files)
+	info.checker.Files(info.Files)
+	if !conf.IgnoreFuncBodies {
+		info.IgnoredFiles = l.parseIgnoredFiles(info.ignored)
+	}
+
+	info.state = checked
+	return nil
+}
+
+// checkTests adds the in-package test files to an already type checked
+// package.
+func (l *loader) checkTests(info *PackageInfo) {
+	if info.testChecked || len(info.testFiles) == 0 {
+		return
+	}
+	info.testChecked = true
+
+	files := l.parseFiles(info, info.testFiles)
+	info.Files = append(info.Files, files...)
+	info.checker.Files(files)
+}
+
+func (l *loader) importPackage(from *PackageInfo, path string) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+
+	info := l.packages[from.imports[path]]
+	if info == nil {
+		return nil, fmt.Errorf("package %q not found", path)
+	}
+	if err := l.check(info); err != nil {
+		return nil, err
+	}
+
+	// External tests may use objects declared in in-package test files.
+	if info.path == from.forTest {
+		l.checkTests(info)
+	}
+	return info.Pkg, nil
+}
+
+func (l *loader) parseFiles(info *PackageInfo, filenames []string) []*ast.File {
+	var files []*ast.File
+	for _, filename := range filenames {
+		src, err := readFile(l.conf.Overlay, filename)
+		if err != nil {
+			info.Errors = append(info.Errors, err)
+			continue
+		}
+		if _, ok := l.conf.Overlay[filename]; !ok {
+			l.hashes[filename] = hashContent(src)
+		}
+
+		f, err := parser.ParseFile(l.fset, filename, src, parser.ParseComments)
+		if err != nil {
+			info.Errors = append(info.Errors, err)
+		}
+		if f != nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// parseIgnoredFiles parses the files excluded by build constraints up to
+// the import declarations. Files failing to parse are skipped, as they
+// are not part of the program.
+func (l *loader) parseIgnoredFiles(filenames []string) []*ast.File {
+	var files []*ast.File
+	for _, filename := range filenames {
+		src, err := readFile(l.conf.Overlay, filename)
+		if err != nil {
+			continue
+		}
+		f, err := parser.ParseFile(l.fset, filename, src, parser.ImportsOnly|parser.ParseComments)
+		if err != nil {
+			continue
+		}
+		if _, ok := l.conf.Overlay[filename]; !ok {
+			l.hashes[filename] = hashContent(src)
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// checkErrors reports hard errors in any package loaded.
+func checkErrors(infos []*PackageInfo) error {
+	var errpkgs []string
+	for _, info := range infos {
+		if containsHardErrors(info.Errors) {
+			errpkgs = append(errpkgs, info.path)
+		}
+	}
+
+	if errpkgs == nil {
+		return nil
+	}
+
+	var more string
+	if len(errpkgs) > 3 {
+		more = fmt.Sprintf(" and %d more", len(errpkgs)-3)
+		errpkgs = errpkgs[:3]
+	}
+	return fmt.Errorf("couldn't load packages due to errors: %s%s",
+		strings.Join(errpkgs, ", "), more)
+}
+
+func containsHardErrors(errors []error) bool {
+	for _, err := range errors {
+		if err, ok := err.(types.Error); ok && err.Soft {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// compiledFiles returns the files to be type checked. Files processed by
+// cgo are replaced by generated files in the build cache, which must not be
+// edited. For cgo packages, and if the build system did not provide the
+// compiled files (e.g. cgo failed), the original files are used and
+// references to "C" are faked, like golang.org/x/tools/go/loader did.
+func compiledFiles(p *packages.Package) ([]string, bool) {
+	switch {
+	case len(p.GoFiles) == 0:
+		return p.CompiledGoFiles, false
+	case len(p.CompiledGoFiles) == 0:
+		return p.GoFiles, true
+	}
+
+	original := map[string]bool{}
+	for _, name := range p.GoFiles {
+		original[name] = true
+	}
+	for _, name := range p.CompiledGoFiles {
+		if !original[name] {
+			return p.GoFiles, true
+		}
+	}
+	return p.CompiledGoFiles, false
+}
+
+// ignoredGoFiles returns the Go files of p excluded by build constraints,
+// which are not yet known.
+func ignoredGoFiles(p *packages.Package, known []string) []string {
+	var files []string
+	for _, name := range p.IgnoredFiles {
+		if strings.HasSuffix(name, ".go") && !containsString(known, name) {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+func containsString(list []string, s string) bool {
+	for _, other := range list {
+		if other == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isTestMain(p *packages.Package) bool {
+	return p.Name == "main" && strings.HasSuffix(p.PkgPath, ".test")
+}
+
+func tokenFileContainsPos(f *token.File, pos token.Pos) bool {
+	p := int(pos)
+	base := f.Base()
+	return base <= p && p < base+f.Size()
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
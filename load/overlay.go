@@ -0,0 +1,58 @@
+package load
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ReadOverlay reads an overlay file. The overlay file is a JSON object
+// mapping file paths to their contents, e.g. the unsaved buffers of an
+// editor. Relative paths are resolved against the current working
+// directory. If filename is "-", the overlay is read from stdin.
+func ReadOverlay(filename string) (map[string][]byte, error) {
+	var data []byte
+	var err error
+	if filename == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var contents map[string]string
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("invalid overlay file %v: %v", filename, err)
+	}
+
+	overlay := make(map[string][]byte, len(contents))
+	for path, content := range contents {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		overlay[abs] = []byte(content)
+	}
+	return overlay, nil
+}
+
+// readFile reads filename from the overlay, falling back to the file on
+// disk.
+func readFile(overlay map[string][]byte, filename string) ([]byte, error) {
+	if content, ok := overlay[filename]; ok {
+		return content, nil
+	}
+	return ioutil.ReadFile(filename)
+}
+
+// hashContent returns the hex encoded SHA-256 hash of content.
+func hashContent(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
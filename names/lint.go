@@ -1,11 +1,9 @@
-package main
+package names
 
 import (
 	"regexp"
 	"strings"
 	"unicode"
-
-	"github.com/urso/gotools/names"
 )
 
 var allCapsRE = regexp.MustCompile(`^[A-Z0-9_]+$`)
@@ -14,7 +12,9 @@ func isAllCaps(name string) bool {
 	return len(name) >= 5 && allCapsRE.MatchString(name) && strings.Contains(name, "_")
 }
 
-func lintName(name string, initialisms *names.Initials) (should string) {
+// Lint returns the name golint suggests for name, or name itself if the
+// name is fine.
+func Lint(name string, initialisms *Initials) (should string) {
 	if name == "_" {
 		return name
 	}
@@ -26,7 +26,7 @@ func lintName(name string, initialisms *names.Initials) (should string) {
 }
 
 // lintName returns a different name if it should be different.
-func doLintName(name string, initialisms *names.Initials) (should string) {
+func doLintName(name string, initialisms *Initials) (should string) {
 	// Fast path for simple cases: "_" and all lowercase.
 	if name == "_" {
 		return name
@@ -92,3 +92,13 @@ func doLintName(name string, initialisms *names.Initials) (should string) {
 	}
 	return string(runes)
 }
+
+// LintPackage returns the name golint suggests for the package name, or
+// name itself if the name is fine. Package names are lower case, without
+// underscores. The '_test' suffix of external test packages is kept.
+func LintPackage(name string) (should string) {
+	if base := strings.TrimSuffix(name, "_test"); base != name && base != "" {
+		return LintPackage(base) + "_test"
+	}
+	return strings.ToLower(strings.Replace(name, "_", "", -1))
+}
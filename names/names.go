@@ -1,6 +1,10 @@
 package names
 
-import "strings"
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
 type Initials struct {
 	initials []map[string]bool
@@ -105,3 +109,18 @@ func IsTestName(t string) bool {
 	}
 	return false
 }
+
+// Unexport returns the unexported form of the name n. Leading initialisms
+// are lowercased as a whole.
+func Unexport(n string, initialisms *Initials) string {
+	if n == "" {
+		return ""
+	}
+
+	if i := initialisms.StartsWith(n); i != "" {
+		return strings.ToLower(i) + n[len(i):]
+	}
+
+	r, _ := utf8.DecodeRuneInString(n)
+	return string(unicode.ToLower(r)) + n[1:]
+}
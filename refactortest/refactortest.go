@@ -0,0 +1,475 @@
+// Package refactortest runs refactorings on packages found in a testdata
+// directory and compares the results with golden files, in the style of
+// golang.org/x/tools/go/analysis/analysistest.
+//
+// The testdata directory uses the GOPATH layout, with the package 'a'
+// being located in testdata/src/a. All packages in testdata/src are loaded,
+// such that renaming exported objects updates all packages importing them.
+// Files are never modified. Instead, the contents of every file with a
+// sibling '.golden' file must match the golden file after the refactoring,
+// and no file without golden file may be changed. The golden file of a file
+// moved to another package directory holds its contents at the new location.
+//
+// Refactorings expected to fail are annotated with comments of the form
+//
+//	// want "regexp"...
+//
+// on the lines the conflicts are reported at. Every conflict must match an
+// expectation on its line, and every expectation must be matched by a
+// conflict.
+package refactortest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urso/gotools/ana"
+	"github.com/urso/gotools/filespec"
+	"github.com/urso/gotools/internal/cmdutil"
+	"github.com/urso/gotools/load"
+	"github.com/urso/gotools/names"
+	"github.com/urso/gotools/renamer"
+	"github.com/urso/gotools/write"
+)
+
+// Testing is the subset of *testing.T used by the harness.
+type Testing interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Result holds the outcome of a refactoring.
+type Result struct {
+	// Files holds the new contents of all files modified.
+	Files write.ChangeSet
+
+	// Conflicts lists the conflicts the refactoring has been rejected with.
+	Conflicts []Conflict
+}
+
+// Conflict is a single line of a conflict reported by the renamer.
+type Conflict struct {
+	Pos     token.Position
+	Message string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%v: %v", c.Pos, c.Message)
+}
+
+// TestData returns the absolute path of the testdata directory of the
+// package being tested.
+func TestData() string {
+	testdata, err := filepath.Abs("testdata")
+	if err != nil {
+		panic(err)
+	}
+	return testdata
+}
+
+// Rename renames the object in package pkg to name. The object is either
+// a package level object like "Name", a field or method like "Type.Field",
+// a type parameter of a generic type or function like "Type.T", or the
+// package clause if empty.
+func Rename(t Testing, dir, pkg, object, name string) *Result {
+	return Run(t, dir, pkg, object, func(string) string { return name })
+}
+
+// Unexport renames the object in package pkg to its unexported name, like
+// goexports does for unused exports.
+func Unexport(t Testing, dir, pkg, object string) *Result {
+	initialisms := names.NewInitials("")
+	return Run(t, dir, pkg, object, func(from string) string {
+		return names.Unexport(from, initialisms)
+	})
+}
+
+// LintRename renames the object in package pkg to the name suggested by
+// golint, like golintrename does.
+func LintRename(t Testing, dir, pkg, object string) *Result {
+	initialisms := names.NewInitials("")
+	return Run(t, dir, pkg, object, func(from string) string {
+		if object == "" {
+			return names.LintPackage(from)
+		}
+		return names.Lint(from, initialisms)
+	})
+}
+
+// Run renames the object in package pkg to the name returned by rename
+// for the current name of the object, and checks the result against the
+// golden files and conflict expectations in dir. Run returns nil if the
+// packages can not be loaded or the object can not be found.
+func Run(t Testing, dir, pkg, object string, rename func(string) string) *Result {
+	prog, info := loadTestData(t, dir, pkg)
+	if info == nil {
+		return nil
+	}
+	objs, err := lookup(prog, info, object)
+	if err != nil {
+		t.Errorf("%v", err)
+		return nil
+	}
+
+	r := renamer.New(prog, rename(objs[0].Name()))
+	r.AddAllPackages(prog.InitialPackages()...)
+	r.Protect(filespec.ProtectGenerated)
+	_, err = r.Update(objs...)
+	return check(t, dir, prog, err, r.Edits, nil)
+}
+
+// Batch renames the objects in package pkg to their new names at once, like
+// goexports and golintrename do. Renames maps the objects, named like for
+// Rename, to their new names. Batch returns nil if the packages can not be
+// loaded or any object can not be found.
+func Batch(t Testing, dir, pkg string, renames map[string]string) *Result {
+	prog, info := loadTestData(t, dir, pkg)
+	if info == nil {
+		return nil
+	}
+
+	objects := make([]string, 0, len(renames))
+	for object := range renames {
+		objects = append(objects, object)
+	}
+	sort.Strings(objects)
+
+	b := renamer.NewBatch(prog)
+	b.AddAllPackages(prog.InitialPackages()...)
+	b.Protect(filespec.ProtectGenerated)
+	for _, object := range objects {
+		objs, err := lookup(prog, info, object)
+		if err != nil {
+			t.Errorf("%v", err)
+			return nil
+		}
+		b.Add(renames[object], objs...)
+	}
+	_, err := b.Update()
+	return check(t, dir, prog, err, b.Edits, nil)
+}
+
+// Move moves the package from to the import path to, like gomvpkg does. The
+// files of the package are moved within the GOPATH layout of dir. The golden
+// file of a file moved holds its expected contents at the new location.
+// Move returns nil if the packages can not be loaded.
+func Move(t Testing, dir, from, to string) *Result {
+	prog, info := loadTestData(t, dir, from)
+	if info == nil {
+		return nil
+	}
+
+	toDir := filepath.Join(dir, "src", filepath.FromSlash(to))
+	m := renamer.NewMover(prog, from, to, toDir)
+	m.AddAllPackages(prog.InitialPackages()...)
+	m.Protect(filespec.ProtectGenerated)
+	_, err := m.Update()
+	return check(t, dir, prog, err, m.Edits, m.Files())
+}
+
+// loadTestData loads all packages in dir, returning the package pkg. The
+// package is nil if loading fails.
+func loadTestData(t Testing, dir, pkg string) (*load.Program, *load.PackageInfo) {
+	src := filepath.Join(dir, "src")
+	paths, err := packagesIn(src)
+	if err != nil {
+		t.Errorf("failed to scan testdata: %v", err)
+		return nil, nil
+	}
+
+	conf := &load.Config{
+		Dir: src,
+		Env: append(os.Environ(), "GOPATH="+dir, "GO111MODULE=off", "GOPROXY=off", "GOFLAGS="),
+	}
+	prog, err := load.Packages(conf, paths)
+	if err != nil {
+		t.Errorf("failed to load testdata: %v", err)
+		return nil, nil
+	}
+
+	info := prog.Package(pkg)
+	if info == nil {
+		t.Errorf("package %v not found in %v", pkg, src)
+	}
+	return prog, info
+}
+
+// check applies the edits of a refactoring, if it succeeded, and checks the
+// result against the golden files and conflict expectations in dir. Moves
+// maps the files moved to their new names.
+func check(t Testing, dir string, prog *load.Program, err error, edits func() []renamer.Edit, moves map[string]string) *Result {
+	result := &Result{Files: write.ChangeSet{}}
+
+	// Every line of a conflict is matched on its own, with the details
+	// being indented like in the output of the commands.
+	var conflicts *renamer.ConflictError
+	if errors.As(err, &conflicts) {
+		add := func(pos token.Position, message string) {
+			pos.Filename = relName(dir, pos.Filename)
+			result.Conflicts = append(result.Conflicts, Conflict{pos, message})
+		}
+		for _, c := range conflicts.Conflicts {
+			add(c.Pos, c.Message)
+			for _, d := range c.Details {
+				add(d.Pos, "\t"+d.Message)
+			}
+		}
+	} else if err != nil {
+		t.Errorf("%v", err)
+		return result
+	}
+
+	if err == nil {
+		set := write.EditSet{}
+		cmdutil.RecordEdits(set, prog.Fset, edits(), "")
+		changes, err := set.Apply(nil, nil)
+		if err != nil {
+			t.Errorf("failed to apply edits: %v", err)
+			return result
+		}
+
+		olds := make([]string, 0, len(moves))
+		for old := range moves {
+			olds = append(olds, old)
+		}
+		sort.Strings(olds)
+		for _, old := range olds {
+			if err := changes.Move(nil, old, moves[old]); err != nil {
+				t.Errorf("failed to move file: %v", err)
+				return result
+			}
+		}
+
+		mem := write.NewMemWriter()
+		write.WriteAll(mem, changes)
+		result.Files = mem.Files
+	}
+
+	checkConflicts(t, dir, prog, result.Conflicts)
+	checkGolden(t, dir, prog, result.Files, moves)
+	return result
+}
+
+// lookup finds the objects to rename by name.
+func lookup(prog *load.Program, info *load.PackageInfo, object string) ([]types.Object, error) {
+	if object == "" {
+		return []types.Object{renamer.PackageClause(info.Pkg)}, nil
+	}
+
+	parts := strings.SplitN(object, ".", 2)
+	obj := info.Pkg.Scope().Lookup(parts[0])
+	if obj == nil {
+		return nil, fmt.Errorf("object %v not found in package %v", parts[0], info.Pkg.Path())
+	}
+	if len(parts) == 2 {
+		member, _, _ := types.LookupFieldOrMethod(obj.Type(), true, info.Pkg, parts[1])
+		if member == nil {
+			member = lookupTypeParam(obj, parts[1])
+		}
+		if member == nil {
+			return nil, fmt.Errorf("field, method or type parameter %v not found in package %v", object, info.Pkg.Path())
+		}
+		obj = member
+	}
+
+	for id, def := range info.Defs {
+		if def == obj {
+			return ana.CollectIdentObjects(prog, info, id)
+		}
+	}
+	return nil, fmt.Errorf("declaration of %v not found in package %v", object, info.Pkg.Path())
+}
+
+// lookupTypeParam finds the type parameter name of the generic type or
+// function obj.
+func lookupTypeParam(obj types.Object, name string) types.Object {
+	var tparams *types.TypeParamList
+	switch t := obj.Type().(type) {
+	case *types.Named:
+		tparams = t.TypeParams()
+	case *types.Signature:
+		tparams = t.TypeParams()
+	}
+	for i := 0; i < tparams.Len(); i++ {
+		if tparam := tparams.At(i).Obj(); tparam.Name() == name {
+			return tparam
+		}
+	}
+	return nil
+}
+
+// packagesIn returns the import paths of all packages in the GOPATH source
+// directory src.
+func packagesIn(src string) (map[string]bool, error) {
+	paths := map[string]bool{}
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if name := fi.Name(); path != src && (name == "testdata" ||
+				strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".go") {
+			rel, err := filepath.Rel(src, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			paths[filepath.ToSlash(rel)] = true
+		}
+		return nil
+	})
+	return paths, err
+}
+
+type lineKey struct {
+	filename string
+	line     int
+}
+
+var wantRE = regexp.MustCompile(`^//\s*want\s+(.*)$`)
+
+// checkConflicts matches the conflicts against the 'want' comments of all
+// files.
+func checkConflicts(t Testing, dir string, prog *load.Program, conflicts []Conflict) {
+	wants := map[lineKey][]*regexp.Regexp{}
+	forEachFile(prog, func(filename string, file *ast.File) {
+		for _, group := range file.Comments {
+			for _, c := range group.List {
+				m := wantRE.FindStringSubmatch(c.Text)
+				if m == nil {
+					continue
+				}
+
+				pos := prog.Fset.Position(c.Pos())
+				key := lineKey{relName(dir, pos.Filename), pos.Line}
+				exprs, err := parseWant(m[1])
+				if err != nil {
+					t.Errorf("%v:%v: invalid expectation: %v", key.filename, key.line, err)
+					continue
+				}
+				wants[key] = append(wants[key], exprs...)
+			}
+		}
+	})
+
+	for _, c := range conflicts {
+		key := lineKey{c.Pos.Filename, c.Pos.Line}
+		matched := false
+		for i, re := range wants[key] {
+			if re.MatchString(c.Message) {
+				wants[key] = append(wants[key][:i], wants[key][i+1:]...)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			t.Errorf("unexpected conflict: %v", c)
+		}
+	}
+
+	var missing []string
+	for key, exprs := range wants {
+		for _, re := range exprs {
+			missing = append(missing, fmt.Sprintf("%v:%v: no conflict matching %q", key.filename, key.line, re))
+		}
+	}
+	sort.Strings(missing)
+	for _, msg := range missing {
+		t.Errorf("%v", msg)
+	}
+}
+
+// parseWant parses the quoted regular expressions of a 'want' comment.
+func parseWant(s string) ([]*regexp.Regexp, error) {
+	var exprs []*regexp.Regexp
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("expected quoted regular expression, found %q", s)
+		}
+		s = s[len(quoted):]
+
+		expr, _ := strconv.Unquote(quoted)
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, re)
+	}
+	return exprs, nil
+}
+
+// checkGolden compares the contents of all files having a golden file
+// with the golden file, and reports files changed without golden file. The
+// contents of files moved are read from their new location.
+func checkGolden(t Testing, dir string, prog *load.Program, changes write.ChangeSet, moves map[string]string) {
+	checked := map[string]bool{}
+	forEachFile(prog, func(filename string, file *ast.File) {
+		if checked[filename] {
+			return
+		}
+		checked[filename] = true
+
+		name := filename
+		if moved, ok := moves[filename]; ok {
+			name = moved
+		}
+
+		golden, err := ioutil.ReadFile(filename + ".golden")
+		if err != nil {
+			if !os.IsNotExist(err) {
+				t.Errorf("failed to read golden file: %v", err)
+			} else if _, changed := changes[name]; changed {
+				t.Errorf("%v: unexpected change (no golden file)", relName(dir, filename))
+			}
+			return
+		}
+
+		content, changed := changes[name]
+		if !changed {
+			if content, err = ioutil.ReadFile(filename); err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+		}
+		if !bytes.Equal(golden, content) {
+			var diff bytes.Buffer
+			write.UnifiedDiff(&diff, relName(dir, filename), golden, content, write.DiffOptions{Context: 3})
+			t.Errorf("%v: result does not match golden file:\n%s", relName(dir, filename), diff.Bytes())
+		}
+	})
+}
+
+// forEachFile calls fn for every file of the packages in testdata,
+// including the files excluded by build constraints.
+func forEachFile(prog *load.Program, fn func(filename string, file *ast.File)) {
+	for _, info := range prog.InitialPackages() {
+		for _, files := range [][]*ast.File{info.Files, info.IgnoredFiles} {
+			for _, f := range files {
+				fn(prog.Fset.PositionFor(f.Pos(), false).Filename, f)
+			}
+		}
+	}
+}
+
+// relName returns filename relative to dir, if possible.
+func relName(dir, filename string) string {
+	if rel, err := filepath.Rel(dir, filename); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return filename
+}
@@ -0,0 +1,59 @@
+package refactortest_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/urso/gotools/refactortest"
+)
+
+func testdata(name string) string {
+	return filepath.Join(refactortest.TestData(), name)
+}
+
+func TestRename(t *testing.T) {
+	refactortest.Rename(t, testdata("rename"), "a", "Foo", "Bar")
+}
+
+func TestRenamePackageClause(t *testing.T) {
+	refactortest.Rename(t, testdata("pkgclause"), "util", "", "helpers")
+}
+
+func TestBatchSwap(t *testing.T) {
+	refactortest.Batch(t, testdata("batch"), "s", map[string]string{
+		"A":       "B",
+		"B":       "A",
+		"Point.X": "Y",
+		"Point.Y": "X",
+	})
+}
+
+func TestRenameGenericMethod(t *testing.T) {
+	refactortest.Rename(t, testdata("generic"), "g", "Stack.Push", "Add")
+}
+
+func TestMove(t *testing.T) {
+	refactortest.Move(t, testdata("move"), "old/lib", "new/util")
+}
+
+func TestConflict(t *testing.T) {
+	r := refactortest.Rename(t, testdata("conflict"), "c", "Foo", "x")
+	if r != nil && len(r.Files) > 0 {
+		t.Errorf("files changed despite conflicts")
+	}
+}
+
+func TestRenameTypeParam(t *testing.T) {
+	refactortest.Rename(t, testdata("typeparam"), "tp", "Map.T", "In")
+}
+
+func TestRenameGenericField(t *testing.T) {
+	refactortest.Rename(t, testdata("genericfield"), "gf", "Box.Value", "Content")
+}
+
+func TestConstraintConflict(t *testing.T) {
+	r := refactortest.Rename(t, testdata("constraint"), "cs", "Name.String", "Text")
+	if r != nil && len(r.Files) > 0 {
+		t.Errorf("files changed despite conflicts")
+	}
+}
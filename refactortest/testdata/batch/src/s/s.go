@@ -0,0 +1,14 @@
+package s
+
+type Point struct {
+	X int
+	Y int
+}
+
+func A() int { return 1 }
+
+func B() int { return 2 }
+
+func Use(p Point) int {
+	return A()*p.X + B()*p.Y
+}
@@ -0,0 +1,8 @@
+package c
+
+func Foo() int { return 1 } // want `renaming this func "Foo" to "x"`
+
+func Bar() int {
+	x := 2           // want "by this intervening var definition"
+	return Foo() + x // want "would cause this reference to become shadowed"
+}
@@ -0,0 +1,25 @@
+package cs
+
+import "strings"
+
+type Stringer interface { // want "would make cs.Name no longer assignable to interface Stringer"
+	String() string // want "rename cs.Stringer.String if you intend to change both types"
+}
+
+// List is a list of values formatted by their String method.
+type List[T Stringer] []T
+
+// Join joins the string representations of the values.
+func (l List[T]) Join() string {
+	var parts []string
+	for _, v := range l {
+		parts = append(parts, v.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+type Name string
+
+func (n Name) String() string { return string(n) } // want `renaming this method "String" to "Text"`
+
+var names List[Name]
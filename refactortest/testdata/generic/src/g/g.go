@@ -0,0 +1,16 @@
+package g
+
+// Stack is a stack of values.
+type Stack[T any] struct {
+	values []T
+}
+
+func (s *Stack[T]) Push(v T) {
+	s.values = append(s.values, v)
+}
+
+func (s *Stack[T]) PushAll(vs ...T) {
+	for _, v := range vs {
+		s.Push(v)
+	}
+}
@@ -0,0 +1,15 @@
+package h
+
+import "g"
+
+func Ints() *g.Stack[int] {
+	var s g.Stack[int]
+	s.Push(1)
+	return &s
+}
+
+func Strings() *g.Stack[string] {
+	s := &g.Stack[string]{}
+	s.Push("a")
+	return s
+}
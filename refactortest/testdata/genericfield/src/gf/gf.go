@@ -0,0 +1,8 @@
+package gf
+
+// Box holds a single value.
+type Box[T any] struct {
+	Value T
+}
+
+func (b *Box[T]) Get() T { return b.Value }
@@ -0,0 +1,12 @@
+package use
+
+import "gf"
+
+// IntBox is a box of ints.
+type IntBox = gf.Box[int]
+
+var box = gf.Box[string]{Value: "a"}
+
+func Get() string { return box.Value }
+
+func Set(b *IntBox, v int) { b.Value = v }
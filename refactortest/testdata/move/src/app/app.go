@@ -0,0 +1,11 @@
+package app
+
+import (
+	"fmt"
+
+	"old/lib"
+)
+
+func Greet() {
+	fmt.Println(lib.Hello())
+}
@@ -0,0 +1,7 @@
+//go:build legacy
+
+package app
+
+import "old/lib"
+
+func Leave() string { return lib.Bye() }
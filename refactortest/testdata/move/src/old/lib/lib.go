@@ -0,0 +1,4 @@
+package lib
+
+// Hello returns a greeting.
+func Hello() string { return "hello" }
@@ -0,0 +1,8 @@
+//go:build legacy
+
+package lib
+
+import "old/lib/text"
+
+// Bye returns a farewell.
+func Bye() string { return text.Bye }
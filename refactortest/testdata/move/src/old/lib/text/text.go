@@ -0,0 +1,4 @@
+package text
+
+// Bye is a farewell.
+const Bye = "bye"
@@ -0,0 +1,7 @@
+package app
+
+import "util"
+
+func Larger(x, y int) int {
+	return util.Max(x, y)
+}
@@ -0,0 +1,9 @@
+//go:build legacy
+
+package app
+
+import "util"
+
+func Smaller(x, y int) int {
+	return util.Min(x, y)
+}
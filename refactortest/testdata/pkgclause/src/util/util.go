@@ -0,0 +1,9 @@
+package util
+
+// Max returns the larger of x and y.
+func Max(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,11 @@
+//go:build legacy
+
+package util
+
+// Min returns the smaller of x and y.
+func Min(x, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
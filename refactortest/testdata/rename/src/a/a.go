@@ -0,0 +1,7 @@
+package a
+
+func Foo() string { return "foo" }
+
+func greet() string {
+	return Foo() + "!"
+}
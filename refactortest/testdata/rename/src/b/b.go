@@ -0,0 +1,6 @@
+package b
+
+import "a"
+
+// Greeting is the greeting of package a.
+var Greeting = a.Foo()
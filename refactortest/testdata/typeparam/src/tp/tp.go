@@ -0,0 +1,15 @@
+package tp
+
+// Map returns the results of f applied to all values.
+func Map[T, U any](values []T, f func(T) U) []U {
+	result := make([]U, 0, len(values))
+	for _, v := range values {
+		result = append(result, f(v))
+	}
+	return result
+}
+
+// Strings formats all values.
+func Strings[T interface{ String() string }](values []T) []string {
+	return Map(values, T.String)
+}
@@ -0,0 +1,284 @@
+package renamer
+
+// This file implements renaming many objects at once.
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+
+	"github.com/urso/gotools/load"
+)
+
+// Batch renames many objects at once. All renames are checked against the
+// original program before any of them is applied, such that renames may
+// depend on each other, like swapping the names of two objects. The checks
+// see every object by the name it will have once all renames of the batch
+// are applied, such that conflicts between the renames themselves, like
+// renaming two objects of the same scope to the same name, are reported.
+// Either all renames are applied, or none.
+type Batch struct {
+	prog     *load.Program
+	packages map[*types.Package]*load.PackageInfo
+	guards   []func(filename string, file *ast.File) error
+	renames  []batchRename
+
+	names  map[types.Object]string   // objects renamed -> new name
+	owners map[types.Object]*Renamer // objects renamed -> rename
+	byName map[string][]types.Object // new name -> objects renamed
+
+	checked bool
+	err     error
+}
+
+type batchRename struct {
+	r    *Renamer
+	objs []types.Object
+}
+
+// NewBatch creates an empty batch of renames of objects in prog.
+func NewBatch(prog *load.Program) *Batch {
+	return &Batch{
+		prog:     prog,
+		packages: map[*types.Package]*load.PackageInfo{},
+		names:    map[types.Object]string{},
+		owners:   map[types.Object]*Renamer{},
+		byName:   map[string][]types.Object{},
+	}
+}
+
+func (b *Batch) AddPackages(pkgs map[string]*load.PackageInfo) {
+	for _, info := range pkgs {
+		b.AddPackage(info)
+	}
+}
+
+func (b *Batch) AddAllPackages(pkgs ...*load.PackageInfo) {
+	for _, info := range pkgs {
+		b.AddPackage(info)
+	}
+}
+
+func (b *Batch) AddPackage(info *load.PackageInfo) {
+	b.packages[info.Pkg] = info
+}
+
+// Protect registers a function checking whether a file may be modified.
+// See Renamer.Protect.
+func (b *Batch) Protect(fn func(filename string, file *ast.File) error) {
+	b.guards = append(b.guards, fn)
+}
+
+// Add adds the renaming of objs to to the batch. objs are the objects
+// declared by a single identifier, like the objects returned by
+// ana.CollectIdentObjects. The returned renamer must not be checked or
+// updated on its own, but reports the edits of the rename once the batch
+// has been updated.
+func (b *Batch) Add(to string, objs ...types.Object) *Renamer {
+	r := New(b.prog, to)
+	r.packages = b.packages
+	r.batch = b
+	b.renames = append(b.renames, batchRename{r, objs})
+
+	for _, obj := range objs {
+		obj = origin(obj)
+		if _, exists := b.owners[obj]; exists {
+			continue // reported by Check
+		}
+		b.names[obj] = to
+		b.owners[obj] = r
+		b.byName[to] = append(b.byName[to], obj)
+	}
+	return r
+}
+
+// Check performs the safety checks of all renames without updating the
+// program. The conflicts of all renames are returned as *ConflictError.
+func (b *Batch) Check() error {
+	if b.checked {
+		return b.err
+	}
+	b.checked = true
+
+	for _, rename := range b.renames {
+		rename.r.guards = b.guards
+		rename.r.Check(rename.objs...)
+	}
+
+	// Objects renamed by more than one rename, either directly or by
+	// being coupled to another object renamed, can not be renamed
+	// consistently.
+	owners := map[types.Object]*Renamer{}
+	for _, rename := range b.renames {
+		r := rename.r
+		objs := make([]types.Object, 0, len(r.objsToUpdate))
+		for obj := range r.objsToUpdate {
+			objs = append(objs, obj)
+		}
+		sort.Slice(objs, func(i, j int) bool {
+			return objs[i].Pos() < objs[j].Pos()
+		})
+
+		for _, obj := range objs {
+			prev, exists := owners[obj]
+			if !exists {
+				owners[obj] = r
+				continue
+			}
+			r.errorf(ConflictBatch, obj, obj.Pos(), "renaming this %s %q to %q",
+				objectKind(obj), obj.Name(), r.to)
+			r.detailf(nil, obj.Pos(), "conflicts with renaming it to %q", prev.to)
+		}
+	}
+
+	var conflicts []Conflict
+	for _, rename := range b.renames {
+		conflicts = append(conflicts, rename.r.conflicts...)
+	}
+	b.err = conflictError(conflicts)
+	return b.err
+}
+
+// Update checks all renames and updates the program, returning the set of
+// updated files. The program is not modified if any rename conflicts.
+func (b *Batch) Update() (map[*token.File]bool, error) {
+	if err := b.Check(); err != nil {
+		return nil, err
+	}
+
+	files := map[*token.File]bool{}
+	for _, rename := range b.renames {
+		for f := range rename.r.doUpdate() {
+			files[f] = true
+		}
+	}
+	return files, nil
+}
+
+// Failed returns the renames that reported conflicts when checking the
+// batch, in the order they have been added.
+func (b *Batch) Failed() []*Renamer {
+	var failed []*Renamer
+	for _, rename := range b.renames {
+		if len(rename.r.conflicts) > 0 {
+			failed = append(failed, rename.r)
+		}
+	}
+	return failed
+}
+
+// Edits returns the changes applied by Update of all renames, ordered by
+// position.
+func (b *Batch) Edits() []Edit {
+	var edits []Edit
+	for _, rename := range b.renames {
+		edits = append(edits, rename.r.edits...)
+	}
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].Pos < edits[j].Pos
+	})
+	return edits
+}
+
+// nameOf returns the name of obj once the other renames of the batch are
+// applied. Objects renamed by r keep their current name, such that the
+// checks of r find them by their old name.
+func (r *Renamer) nameOf(obj types.Object) string {
+	if r.batch == nil {
+		return obj.Name()
+	}
+	o := origin(obj)
+	if to, ok := r.batch.names[o]; ok && r.batch.owners[o] != r && !r.objsToUpdate[o] {
+		return to
+	}
+	return obj.Name()
+}
+
+// renamedTo returns the objects other renames of the batch rename to name.
+func (r *Renamer) renamedTo(name string) []types.Object {
+	if r.batch == nil {
+		return nil
+	}
+	var objs []types.Object
+	for _, obj := range r.batch.byName[name] {
+		if r.batch.owners[obj] != r && !r.objsToUpdate[obj] {
+			objs = append(objs, obj)
+		}
+	}
+	return objs
+}
+
+// lookup is like (*types.Scope).Lookup, but sees the objects by their
+// names after all other renames of the batch are applied.
+func (r *Renamer) lookup(scope *types.Scope, name string) types.Object {
+	if obj := scope.Lookup(name); obj != nil && r.nameOf(obj) == name {
+		return obj
+	}
+	for _, obj := range r.renamedTo(name) {
+		if obj.Parent() == scope {
+			return obj
+		}
+	}
+	return nil
+}
+
+// lookupParent is like (*types.Scope).LookupParent, but sees the objects by
+// their names after all other renames of the batch are applied.
+func (r *Renamer) lookupParent(scope *types.Scope, name string, pos token.Pos) (*types.Scope, types.Object) {
+	for s := scope; s != nil; s = s.Parent() {
+		obj := r.lookup(s, name)
+		if obj == nil {
+			continue
+		}
+		if pos.IsValid() {
+			if obj.Name() == name {
+				// Let go/types decide whether the declaration is in
+				// scope at pos.
+				if _, visible := s.LookupParent(name, pos); visible != obj {
+					continue
+				}
+			} else if !isPackageLevel(obj) && obj.Pos() >= pos {
+				continue
+			}
+		}
+		return s, obj
+	}
+	return nil, nil
+}
+
+// lookupFieldOrMethod is like types.LookupFieldOrMethod, but sees the
+// fields and methods by their names after all other renames of the batch
+// are applied. Fields and methods renamed away hide promoted fields and
+// methods of the same name.
+func (r *Renamer) lookupFieldOrMethod(T types.Type, addressable bool, pkg *types.Package, name string) (types.Object, []int, bool) {
+	obj, index, indirect := types.LookupFieldOrMethod(T, addressable, pkg, name)
+	if obj != nil && r.nameOf(obj) != name {
+		obj, index, indirect = nil, nil, false
+	}
+	for _, renamed := range r.renamedTo(name) {
+		other, i, ind := types.LookupFieldOrMethod(T, addressable, renamed.Pkg(), renamed.Name())
+		if origin(other) == renamed && (obj == nil || len(i) < len(index)) {
+			obj, index, indirect = other, i, ind
+		}
+	}
+	return obj, index, indirect
+}
+
+// lookupMethod is like (*types.MethodSet).Lookup on the method set of T,
+// but sees the methods by their names after all other renames of the batch
+// are applied.
+func (r *Renamer) lookupMethod(T types.Type, pkg *types.Package, name string) *types.Selection {
+	mset := r.msets.MethodSet(T)
+	sel := mset.Lookup(pkg, name)
+	if sel != nil && r.nameOf(sel.Obj()) != name {
+		sel = nil
+	}
+	for _, renamed := range r.renamedTo(name) {
+		other := mset.Lookup(renamed.Pkg(), renamed.Name())
+		if other != nil && origin(other.Obj()) == renamed && (sel == nil || len(other.Index()) < len(sel.Index())) {
+			sel = other
+		}
+	}
+	return sel
+}
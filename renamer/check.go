@@ -3,33 +3,35 @@ package renamer
 // This file defines the safety checks for each kind of renaming.
 
 import (
-	"fmt"
 	"go/ast"
 	"go/token"
 	"go/types"
+	"sort"
 
-	"golang.org/x/tools/go/loader"
 	"golang.org/x/tools/refactor/satisfy"
-)
 
-// errorf reports an error (e.g. conflict) and prevents file modification.
-func (r *Renamer) errorf(pos token.Pos, format string, args ...interface{}) {
-	r.hadConflicts = true
-	ReportError(r.iprog.Fset.Position(pos), fmt.Sprintf(format, args...))
-}
+	"github.com/urso/gotools/load"
+)
 
 // check performs safety checks of the renaming of the 'from' object to r.to.
+// Objects of instantiated types and functions are renamed at their generic
+// declaration.
 func (r *Renamer) check(from types.Object) {
+	from = origin(from)
 	if r.objsToUpdate[from] {
 		return
 	}
 	r.objsToUpdate[from] = true
 
 	// NB: order of conditions is important.
-	if pkg, ok := from.(*types.PkgName); ok {
+	if pkg, ok := isPackageClause(from); ok {
+		r.checkPackageClause(pkg)
+	} else if pkg, ok := from.(*types.PkgName); ok {
 		r.checkInFileBlock(pkg)
 	} else if lbl, ok := from.(*types.Label); ok {
 		r.checkLabel(lbl)
+	} else if tn, ok := from.(*types.TypeName); ok && isTypeParam(tn) {
+		r.checkTypeParam(tn)
 	} else if isPackageLevel(from) {
 		r.checkInPackageBlock(from)
 	} else if v, ok := from.(*types.Var); ok && v.IsField() {
@@ -39,7 +41,7 @@ func (r *Renamer) check(from types.Object) {
 	} else if isLocal(from) {
 		r.checkInLocalScope(from)
 	} else {
-		r.errorf(from.Pos(), "unexpected %s object %q (please report a bug)\n",
+		r.errorf(ConflictBug, from, from.Pos(), "unexpected %s object %q (please report a bug)\n",
 			objectKind(from), from)
 	}
 }
@@ -47,22 +49,7 @@ func (r *Renamer) check(from types.Object) {
 // checkInFileBlock performs safety checks for renames of objects in the file block,
 // i.e. imported package names.
 func (r *Renamer) checkInFileBlock(from *types.PkgName) {
-	// Check import name is not "init".
-	if r.to == "init" {
-		r.errorf(from.Pos(), "%q is not a valid imported package name", r.to)
-	}
-
-	// Check for conflicts between file and package block.
-	if prev := from.Pkg().Scope().Lookup(r.to); prev != nil {
-		r.errorf(from.Pos(), "renaming this %s %q to %q would conflict",
-			objectKind(from), from.Name(), r.to)
-		r.errorf(prev.Pos(), "\twith this package member %s",
-			objectKind(prev))
-		return // since checkInPackageBlock would report redundant errors
-	}
-
-	// Check for conflicts in lexical scope.
-	r.checkInLexicalScope(from, r.packages[from.Pkg()])
+	r.checkImportName(from)
 
 	// Finally, modify ImportSpec syntax to add or remove the Name as needed.
 	info, path, _ := r.iprog.PathEnclosingInterval(from.Pos(), from.Pos())
@@ -78,6 +65,27 @@ func (r *Renamer) checkInFileBlock(from *types.PkgName) {
 	}
 }
 
+// checkImportName checks for conflicts of the imported package name from
+// being renamed to r.to.
+func (r *Renamer) checkImportName(from *types.PkgName) {
+	// Check import name is not "init".
+	if r.to == "init" {
+		r.errorf(ConflictInvalid, from, from.Pos(), "%q is not a valid imported package name", r.to)
+	}
+
+	// Check for conflicts between file and package block.
+	if prev := r.lookup(from.Pkg().Scope(), r.to); prev != nil {
+		r.errorf(ConflictDeclaration, from, from.Pos(), "renaming this %s %q to %q would conflict",
+			objectKind(from), from.Name(), r.to)
+		r.detailf(prev, prev.Pos(), "with this package member %s",
+			objectKind(prev))
+		return // since checkInPackageBlock would report redundant errors
+	}
+
+	// Check for conflicts in lexical scope.
+	r.checkInLexicalScope(from, r.packages[from.Pkg()])
+}
+
 // checkInPackageBlock performs safety checks for renames of
 // func/var/const/type objects in the package block.
 func (r *Renamer) checkInPackageBlock(from types.Object) {
@@ -104,15 +112,15 @@ func (r *Renamer) checkInPackageBlock(from types.Object) {
 			// Reject if intra-package references to it exist.
 			for id, obj := range info.Uses {
 				if obj == from {
-					r.errorf(from.Pos(),
+					r.errorf(ConflictInvalid, from, from.Pos(),
 						"renaming this func %q to %q would make it a package initializer",
 						from.Name(), r.to)
-					r.errorf(id.Pos(), "\tbut references to it exist")
+					r.detailf(nil, id.Pos(), "but references to it exist")
 					break
 				}
 			}
 		} else {
-			r.errorf(from.Pos(), "you cannot have a %s at package level named %q",
+			r.errorf(ConflictInvalid, from, from.Pos(), "you cannot have a %s at package level named %q",
 				kind, r.to)
 		}
 	}
@@ -120,11 +128,11 @@ func (r *Renamer) checkInPackageBlock(from types.Object) {
 	// Check for conflicts between package block and all file blocks.
 	for _, f := range info.Files {
 		fileScope := info.Info.Scopes[f]
-		b, prev := fileScope.LookupParent(r.to, token.NoPos)
+		b, prev := r.lookupParent(fileScope, r.to, token.NoPos)
 		if b == fileScope {
-			r.errorf(from.Pos(), "renaming this %s %q to %q would conflict",
+			r.errorf(ConflictDeclaration, from, from.Pos(), "renaming this %s %q to %q would conflict",
 				objectKind(from), from.Name(), r.to)
-			r.errorf(prev.Pos(), "\twith this %s",
+			r.detailf(prev, prev.Pos(), "with this %s",
 				objectKind(prev))
 			return // since checkInPackageBlock would report redundant errors
 		}
@@ -203,15 +211,15 @@ func (r *Renamer) checkInLocalScope(from types.Object) {
 // Removing the old name (and all references to it) is always safe, and
 // requires no checks.
 //
-func (r *Renamer) checkInLexicalScope(from types.Object, info *loader.PackageInfo) {
+func (r *Renamer) checkInLexicalScope(from types.Object, info *load.PackageInfo) {
 	b := from.Parent() // the block defining the 'from' object
 	if b != nil {
-		toBlock, to := b.LookupParent(r.to, from.Parent().End())
+		toBlock, to := r.lookupParent(b, r.to, from.Parent().End())
 		if toBlock == b {
 			// same-block conflict
-			r.errorf(from.Pos(), "renaming this %s %q to %q",
+			r.errorf(ConflictDeclaration, from, from.Pos(), "renaming this %s %q to %q",
 				objectKind(from), from.Name(), r.to)
-			r.errorf(to.Pos(), "\tconflicts with %s in same block",
+			r.detailf(to, to.Pos(), "conflicts with %s in same block",
 				objectKind(to))
 			return
 		} else if toBlock != nil {
@@ -219,13 +227,13 @@ func (r *Renamer) checkInLexicalScope(from types.Object, info *loader.PackageInf
 			// The name r.to is defined in a superblock.
 			// Is that name referenced from within this block?
 			forEachLexicalRef(info, to, func(id *ast.Ident, block *types.Scope) bool {
-				_, obj := lexicalLookup(block, from.Name(), id.Pos())
+				_, obj := r.lexicalLookup(block, from.Name(), id.Pos())
 				if obj == from {
 					// super-block conflict
-					r.errorf(from.Pos(), "renaming this %s %q to %q",
+					r.errorf(ConflictShadowing, from, from.Pos(), "renaming this %s %q to %q",
 						objectKind(from), from.Name(), r.to)
-					r.errorf(id.Pos(), "\twould shadow this reference")
-					r.errorf(to.Pos(), "\tto the %s declared here",
+					r.detailf(nil, id.Pos(), "would shadow this reference")
+					r.detailf(to, to.Pos(), "to the %s declared here",
 						objectKind(to))
 					return false // stop
 				}
@@ -240,17 +248,17 @@ func (r *Renamer) checkInLexicalScope(from types.Object, info *loader.PackageInf
 	forEachLexicalRef(info, from, func(id *ast.Ident, block *types.Scope) bool {
 		// Find the block that defines the found reference.
 		// It may be an ancestor.
-		fromBlock, _ := lexicalLookup(block, from.Name(), id.Pos())
+		fromBlock, _ := r.lexicalLookup(block, from.Name(), id.Pos())
 
 		// See what r.to would resolve to in the same scope.
-		toBlock, to := lexicalLookup(block, r.to, id.Pos())
+		toBlock, to := r.lexicalLookup(block, r.to, id.Pos())
 		if to != nil {
 			// sub-block conflict
 			if deeper(toBlock, fromBlock) {
-				r.errorf(from.Pos(), "renaming this %s %q to %q",
+				r.errorf(ConflictShadowing, from, from.Pos(), "renaming this %s %q to %q",
 					objectKind(from), from.Name(), r.to)
-				r.errorf(id.Pos(), "\twould cause this reference to become shadowed")
-				r.errorf(to.Pos(), "\tby this intervening %s definition",
+				r.detailf(nil, id.Pos(), "would cause this reference to become shadowed")
+				r.detailf(to, to.Pos(), "by this intervening %s definition",
 					objectKind(to))
 				return false // stop
 			}
@@ -277,9 +285,9 @@ func (r *Renamer) checkInLexicalScope(from types.Object, info *loader.PackageInf
 // lexicalLookup is like (*types.Scope).LookupParent but respects the
 // environment visible at pos.  It assumes the relative position
 // information is correct with each file.
-func lexicalLookup(block *types.Scope, name string, pos token.Pos) (*types.Scope, types.Object) {
+func (r *Renamer) lexicalLookup(block *types.Scope, name string, pos token.Pos) (*types.Scope, types.Object) {
 	for b := block; b != nil; b = b.Parent() {
-		obj := b.Lookup(name)
+		obj := r.lookup(b, name)
 		// The scope of a package-level object is the entire package,
 		// so ignore pos in that case.
 		// No analogous clause is needed for file-level objects
@@ -306,7 +314,7 @@ func deeper(x, y *types.Scope) bool {
 // info that is a reference to obj in lexical scope.  block is the
 // lexical block enclosing the reference.  If fn returns false the
 // iteration is terminated and findLexicalRefs returns false.
-func forEachLexicalRef(info *loader.PackageInfo, obj types.Object, fn func(id *ast.Ident, block *types.Scope) bool) bool {
+func forEachLexicalRef(info *load.PackageInfo, obj types.Object, fn func(id *ast.Ident, block *types.Scope) bool) bool {
 	ok := true
 	var stack []ast.Node
 
@@ -394,12 +402,20 @@ func enclosingBlock(info *types.Info, stack []ast.Node) *types.Scope {
 func (r *Renamer) checkLabel(label *types.Label) {
 	// Check there are no identical labels in the function's label block.
 	// (Label blocks don't nest, so this is easy.)
-	if prev := label.Parent().Lookup(r.to); prev != nil {
-		r.errorf(label.Pos(), "renaming this label %q to %q", label.Name(), prev.Name())
-		r.errorf(prev.Pos(), "\twould conflict with this one")
+	if prev := r.lookup(label.Parent(), r.to); prev != nil {
+		r.errorf(ConflictDeclaration, label, label.Pos(), "renaming this label %q to %q", label.Name(), prev.Name())
+		r.detailf(prev, prev.Pos(), "would conflict with this one")
 	}
 }
 
+// checkTypeParam performs safety checks for renaming a type parameter. Type
+// parameters are scoped to the declaration of their generic type or
+// function, and the type parameters of methods are declared by the
+// receiver. Both are lexical scopes nested in the file block.
+func (r *Renamer) checkTypeParam(from *types.TypeName) {
+	r.checkInLexicalScope(from, r.packages[from.Pkg()])
+}
+
 // checkStructField checks that the field renaming will not cause
 // conflicts at its declaration, or ambiguity or changes to any selection.
 func (r *Renamer) checkStructField(from *types.Var) {
@@ -437,11 +453,11 @@ func (r *Renamer) checkStructField(from *types.Var) {
 		// We must check for direct (non-promoted) field/field
 		// and method/field conflicts.
 		named := info.Defs[spec.Name].Type()
-		prev, indices, _ := types.LookupFieldOrMethod(named, true, info.Pkg, r.to)
+		prev, indices, _ := r.lookupFieldOrMethod(named, true, info.Pkg, r.to)
 		if len(indices) == 1 {
-			r.errorf(from.Pos(), "renaming this field %q to %q",
+			r.errorf(ConflictDeclaration, from, from.Pos(), "renaming this field %q to %q",
 				from.Name(), r.to)
-			r.errorf(prev.Pos(), "\twould conflict with this %s",
+			r.detailf(prev, prev.Pos(), "would conflict with this %s",
 				objectKind(prev))
 			return // skip checkSelections to avoid redundant errors
 		}
@@ -450,10 +466,10 @@ func (r *Renamer) checkStructField(from *types.Var) {
 		// We need only check for direct (non-promoted) field/field conflicts.
 		T := info.Types[tStruct].Type.Underlying().(*types.Struct)
 		for i := 0; i < T.NumFields(); i++ {
-			if prev := T.Field(i); prev.Name() == r.to {
-				r.errorf(from.Pos(), "renaming this field %q to %q",
+			if prev := T.Field(i); r.nameOf(prev) == r.to {
+				r.errorf(ConflictDeclaration, from, from.Pos(), "renaming this field %q to %q",
 					from.Name(), r.to)
-				r.errorf(prev.Pos(), "\twould conflict with this field")
+				r.detailf(prev, prev.Pos(), "would conflict with this field")
 				return // skip checkSelections to avoid redundant errors
 			}
 		}
@@ -508,8 +524,10 @@ func (r *Renamer) checkSelections(from types.Object) {
 			// TODO(adonovan): test with pointer, value, addressable value.
 			isAddressable := true
 
-			if sel.Obj() == from {
-				if obj, indices, _ := types.LookupFieldOrMethod(sel.Recv(), isAddressable, from.Pkg(), r.to); obj != nil {
+			// Selections on instantiated types select instantiated
+			// fields and methods.
+			if origin(sel.Obj()) == from {
+				if obj, indices, _ := r.lookupFieldOrMethod(sel.Recv(), isAddressable, from.Pkg(), r.to); obj != nil {
 					// Renaming this existing selection of
 					// 'from' may block access to an existing
 					// type member named 'to'.
@@ -521,8 +539,8 @@ func (r *Renamer) checkSelections(from types.Object) {
 					return
 				}
 
-			} else if sel.Obj().Name() == r.to {
-				if obj, indices, _ := types.LookupFieldOrMethod(sel.Recv(), isAddressable, from.Pkg(), from.Name()); obj == from {
+			} else if r.nameOf(sel.Obj()) == r.to {
+				if obj, indices, _ := types.LookupFieldOrMethod(sel.Recv(), isAddressable, from.Pkg(), from.Name()); origin(obj) == from {
 					// Renaming 'from' may cause this existing
 					// selection of the name 'to' to change
 					// its meaning.
@@ -539,25 +557,25 @@ func (r *Renamer) checkSelections(from types.Object) {
 }
 
 func (r *Renamer) selectionConflict(from types.Object, delta int, syntax *ast.SelectorExpr, obj types.Object) {
-	r.errorf(from.Pos(), "renaming this %s %q to %q",
+	r.errorf(ConflictSelection, from, from.Pos(), "renaming this %s %q to %q",
 		objectKind(from), from.Name(), r.to)
 
 	switch {
 	case delta < 0:
 		// analogous to sub-block conflict
-		r.errorf(syntax.Sel.Pos(),
-			"\twould change the referent of this selection")
-		r.errorf(obj.Pos(), "\tof this %s", objectKind(obj))
+		r.detailf(nil, syntax.Sel.Pos(),
+			"would change the referent of this selection")
+		r.detailf(obj, obj.Pos(), "of this %s", objectKind(obj))
 	case delta == 0:
 		// analogous to same-block conflict
-		r.errorf(syntax.Sel.Pos(),
-			"\twould make this reference ambiguous")
-		r.errorf(obj.Pos(), "\twith this %s", objectKind(obj))
+		r.detailf(nil, syntax.Sel.Pos(),
+			"would make this reference ambiguous")
+		r.detailf(obj, obj.Pos(), "with this %s", objectKind(obj))
 	case delta > 0:
 		// analogous to super-block conflict
-		r.errorf(syntax.Sel.Pos(),
-			"\twould shadow this selection")
-		r.errorf(obj.Pos(), "\tof the %s declared here",
+		r.detailf(nil, syntax.Sel.Pos(),
+			"would shadow this selection")
+		r.detailf(obj, obj.Pos(), "of the %s declared here",
 			objectKind(obj))
 	}
 }
@@ -574,7 +592,7 @@ func (r *Renamer) selectionConflict(from types.Object, delta int, syntax *ast.Se
 func (r *Renamer) checkMethod(from *types.Func) {
 	// e.g. error.Error
 	if from.Pkg() == nil {
-		r.errorf(from.Pos(), "you cannot rename built-in method %s", from)
+		r.errorf(ConflictInvalid, from, from.Pos(), "you cannot rename built-in method %s", from)
 		return
 	}
 
@@ -591,11 +609,11 @@ func (r *Renamer) checkMethod(from *types.Func) {
 		// Abstract method
 
 		// declaration
-		prev, _, _ := types.LookupFieldOrMethod(R, false, from.Pkg(), r.to)
+		prev, _, _ := r.lookupFieldOrMethod(R, false, from.Pkg(), r.to)
 		if prev != nil {
-			r.errorf(from.Pos(), "renaming this interface method %q to %q",
+			r.errorf(ConflictDeclaration, from, from.Pos(), "renaming this interface method %q to %q",
 				from.Name(), r.to)
-			r.errorf(prev.Pos(), "\twould conflict with this method")
+			r.detailf(prev, prev.Pos(), "would conflict with this method")
 			return
 		}
 
@@ -604,21 +622,23 @@ func (r *Renamer) checkMethod(from *types.Func) {
 		for _, info := range r.packages {
 			// Start with named interface types (better errors)
 			for _, obj := range info.Defs {
-				if obj, ok := obj.(*types.TypeName); ok && isInterface(obj.Type()) {
+				// Type parameters are interfaces as well, but
+				// their constraints are checked on their own.
+				if obj, ok := obj.(*types.TypeName); ok && !isTypeParam(obj) && isInterface(obj.Type()) {
 					f, _, _ := types.LookupFieldOrMethod(
 						obj.Type(), false, from.Pkg(), from.Name())
 					if f == nil {
 						continue
 					}
-					t, _, _ := types.LookupFieldOrMethod(
+					t, _, _ := r.lookupFieldOrMethod(
 						obj.Type(), false, from.Pkg(), r.to)
 					if t == nil {
 						continue
 					}
-					r.errorf(from.Pos(), "renaming this interface method %q to %q",
+					r.errorf(ConflictDeclaration, from, from.Pos(), "renaming this interface method %q to %q",
 						from.Name(), r.to)
-					r.errorf(t.Pos(), "\twould conflict with this method")
-					r.errorf(obj.Pos(), "\tin named interface type %q", obj.Name())
+					r.detailf(t, t.Pos(), "would conflict with this method")
+					r.detailf(obj, obj.Pos(), "in named interface type %q", obj.Name())
 				}
 			}
 
@@ -654,10 +674,10 @@ func (r *Renamer) checkMethod(from *types.Func) {
 			// and one of them is m, the other must be coupled.
 			var coupled *types.Func
 			switch from {
-			case lsel.Obj():
-				coupled = rsel.Obj().(*types.Func)
-			case rsel.Obj():
-				coupled = lsel.Obj().(*types.Func)
+			case origin(lsel.Obj()):
+				coupled = origin(rsel.Obj()).(*types.Func)
+			case origin(rsel.Obj()):
+				coupled = origin(lsel.Obj()).(*types.Func)
 			default:
 				continue
 			}
@@ -679,7 +699,7 @@ func (r *Renamer) checkMethod(from *types.Func) {
 			if !isInterface(key.RHS) {
 				// The logic below was derived from checkSelections.
 
-				rtosel := rmethods.Lookup(from.Pkg(), r.to)
+				rtosel := r.lookupMethod(key.RHS, from.Pkg(), r.to)
 				if rtosel != nil {
 					rto := rtosel.Obj().(*types.Func)
 					delta := len(rsel.Index()) - len(rtosel.Index())
@@ -690,21 +710,21 @@ func (r *Renamer) checkMethod(from *types.Func) {
 					// TODO(adonovan): record the constraint's position.
 					keyPos := token.NoPos
 
-					r.errorf(from.Pos(), "renaming this method %q to %q",
+					r.errorf(ConflictMethodSet, from, from.Pos(), "renaming this method %q to %q",
 						from.Name(), r.to)
 					if delta == 0 {
 						// analogous to same-block conflict
-						r.errorf(keyPos, "\twould make the %s method of %s invoked via interface %s ambiguous",
+						r.detailf(nil, keyPos, "would make the %s method of %s invoked via interface %s ambiguous",
 							r.to, key.RHS, key.LHS)
-						r.errorf(rto.Pos(), "\twith (%s).%s",
+						r.detailf(rto, rto.Pos(), "with (%s).%s",
 							recv(rto).Type(), r.to)
 					} else {
 						// analogous to super-block conflict
-						r.errorf(keyPos, "\twould change the %s method of %s invoked via interface %s",
+						r.detailf(nil, keyPos, "would change the %s method of %s invoked via interface %s",
 							r.to, key.RHS, key.LHS)
-						r.errorf(coupled.Pos(), "\tfrom (%s).%s",
+						r.detailf(coupled, coupled.Pos(), "from (%s).%s",
 							recv(coupled).Type(), r.to)
-						r.errorf(rto.Pos(), "\tto (%s).%s",
+						r.detailf(rto, rto.Pos(), "to (%s).%s",
 							recv(rto).Type(), r.to)
 					}
 					return // one error is enough
@@ -713,9 +733,9 @@ func (r *Renamer) checkMethod(from *types.Func) {
 
 			if !r.changeMethods {
 				// This should be unreachable.
-				r.errorf(from.Pos(), "internal error: during renaming of abstract method %s", from)
-				r.errorf(coupled.Pos(), "\tchangedMethods=false, coupled method=%s", coupled)
-				r.errorf(from.Pos(), "\tPlease file a bug report")
+				r.errorf(ConflictBug, from, from.Pos(), "internal error: during renaming of abstract method %s", from)
+				r.detailf(coupled, coupled.Pos(), "changedMethods=false, coupled method=%s", coupled)
+				r.detailf(nil, from.Pos(), "Please file a bug report")
 				return
 			}
 
@@ -726,11 +746,11 @@ func (r *Renamer) checkMethod(from *types.Func) {
 		// Concrete method
 
 		// declaration
-		prev, indices, _ := types.LookupFieldOrMethod(R, true, from.Pkg(), r.to)
+		prev, indices, _ := r.lookupFieldOrMethod(R, true, from.Pkg(), r.to)
 		if prev != nil && len(indices) == 1 {
-			r.errorf(from.Pos(), "renaming this method %q to %q",
+			r.errorf(ConflictDeclaration, from, from.Pos(), "renaming this method %q to %q",
 				from.Name(), r.to)
-			r.errorf(prev.Pos(), "\twould conflict with this %s",
+			r.detailf(prev, prev.Pos(), "would conflict with this %s",
 				objectKind(prev))
 			return
 		}
@@ -755,19 +775,19 @@ func (r *Renamer) checkMethod(from *types.Func) {
 				continue
 			}
 			rsel := r.msets.MethodSet(key.RHS).Lookup(from.Pkg(), from.Name())
-			if rsel == nil || rsel.Obj() != from {
+			if rsel == nil || origin(rsel.Obj()) != from {
 				continue // rhs does not have the method
 			}
 			lsel := r.msets.MethodSet(key.LHS).Lookup(from.Pkg(), from.Name())
 			if lsel == nil {
 				continue
 			}
-			imeth := lsel.Obj().(*types.Func)
+			imeth := origin(lsel.Obj()).(*types.Func)
 
 			// imeth is the abstract method (e.g. I.f)
 			// and key.RHS is the concrete coupling type (e.g. D).
 			if !r.changeMethods {
-				r.errorf(from.Pos(), "renaming this method %q to %q",
+				r.errorf(ConflictSatisfaction, from, from.Pos(), "renaming this method %q to %q",
 					from.Name(), r.to)
 				var pos token.Pos
 				var iface string
@@ -780,9 +800,9 @@ func (r *Renamer) checkMethod(from *types.Func) {
 					pos = from.Pos()
 					iface = I.String()
 				}
-				r.errorf(pos, "\twould make %s no longer assignable to %s",
+				r.detailf(nil, pos, "would make %s no longer assignable to %s",
 					key.RHS, iface)
-				r.errorf(imeth.Pos(), "\t(rename %s.%s if you intend to change both types)",
+				r.detailf(imeth, imeth.Pos(), "(rename %s.%s if you intend to change both types)",
 					I, from.Name())
 				return // one error is enough
 			}
@@ -797,15 +817,98 @@ func (r *Renamer) checkMethod(from *types.Func) {
 	r.checkSelections(from)
 }
 
+// checkProtected checks that the renaming does not modify any file
+// rejected by the guards registered via Protect.
+func (r *Renamer) checkProtected() {
+	if len(r.guards) == 0 {
+		return
+	}
+
+	for _, info := range r.packages {
+		// first identifier to be renamed per file
+		updates := map[*token.File]*ast.Ident{}
+		for _, m := range []map[*ast.Ident]types.Object{info.Defs, info.Uses} {
+			for id, obj := range m {
+				if !r.objsToUpdate[origin(obj)] {
+					continue
+				}
+
+				file := r.iprog.Fset.File(id.Pos())
+				if prev := updates[file]; prev == nil || id.Pos() < prev.Pos() {
+					updates[file] = id
+				}
+			}
+		}
+
+		for _, f := range info.Files {
+			file := r.iprog.Fset.File(f.FileStart)
+			id := updates[file]
+			if id == nil {
+				continue
+			}
+
+			for _, guard := range r.guards {
+				if err := guard(file.Name(), f); err != nil {
+					obj := info.Defs[id]
+					if obj == nil {
+						obj = info.Uses[id]
+					}
+					r.errorf(ConflictProtected, obj, id.Pos(), "renaming this %s %q to %q would modify a protected file",
+						objectKind(obj), obj.Name(), r.to)
+					r.detailf(nil, id.Pos(), "%v", err)
+					break
+				}
+			}
+		}
+	}
+
+	// Objects declared in dependencies (e.g. vendored packages) are
+	// renamed in their declaring file as well.
+	var deps []types.Object
+	for obj := range r.objsToUpdate {
+		if _, ok := isPackageClause(obj); ok {
+			continue
+		}
+		if pkg := obj.Pkg(); pkg != nil && r.packages[pkg] == nil {
+			deps = append(deps, obj)
+		}
+	}
+	sort.Slice(deps, func(i, j int) bool {
+		return deps[i].Pos() < deps[j].Pos()
+	})
+	for _, obj := range deps {
+		info := r.iprog.AllPackages[obj.Pkg()]
+		if info == nil {
+			continue
+		}
+
+		file := r.iprog.Fset.File(obj.Pos())
+		for _, f := range info.Files {
+			if r.iprog.Fset.File(f.FileStart) != file {
+				continue
+			}
+
+			for _, guard := range r.guards {
+				if err := guard(file.Name(), f); err != nil {
+					r.errorf(ConflictProtected, obj, obj.Pos(), "renaming this %s %q to %q would modify a protected file",
+						objectKind(obj), obj.Name(), r.to)
+					r.detailf(nil, obj.Pos(), "%v", err)
+					break
+				}
+			}
+		}
+	}
+}
+
 func (r *Renamer) checkExport(id *ast.Ident, pkg *types.Package, from types.Object) bool {
 	// Reject cross-package references if r.to is unexported.
 	// (Such references may be qualified identifiers or field/method
 	// selections.)
 	if !ast.IsExported(r.to) && pkg != from.Pkg() {
-		r.errorf(from.Pos(),
+		r.errorf(ConflictUnexport, from, from.Pos(),
 			"renaming this %s %q to %q would make it unexported",
 			objectKind(from), from.Name(), r.to)
-		r.errorf(id.Pos(), "\tbreaking references from packages such as %q",
+		r.detailf(nil, id.Pos(), "breaking references from packages such as %q",
 			pkg.Path())
 		return false
 	}
@@ -821,10 +924,43 @@ func (r *Renamer) satisfy() map[satisfy.Constraint]bool {
 			f.Find(&info.Info, info.Files)
 		}
 		r.satisfyConstraints = f.Result
+		if r.satisfyConstraints == nil {
+			r.satisfyConstraints = map[satisfy.Constraint]bool{}
+		}
+		for _, info := range r.packages {
+			instanceConstraints(r.satisfyConstraints, info)
+		}
 	}
 	return r.satisfyConstraints
 }
 
+// instanceConstraints adds the constraints of instantiating generic types
+// and functions to result: every type argument must satisfy the constraint
+// of its type parameter. Only constraints declaring methods are recorded.
+// Type arguments being type parameters themselves satisfy the constraint
+// via their own constraint.
+func instanceConstraints(result map[satisfy.Constraint]bool, info *load.PackageInfo) {
+	for id, inst := range info.Instances {
+		obj := info.Uses[id]
+		if obj == nil {
+			continue
+		}
+		tparams := typeParams(obj)
+		for i := 0; i < tparams.Len() && i < inst.TypeArgs.Len(); i++ {
+			constraint := tparams.At(i).Constraint()
+			if iface, ok := constraint.Underlying().(*types.Interface); !ok || iface.NumMethods() == 0 {
+				continue
+			}
+
+			targ := inst.TypeArgs.At(i)
+			if tparam, ok := targ.(*types.TypeParam); ok {
+				targ = tparam.Constraint()
+			}
+			result[satisfy.Constraint{LHS: constraint, RHS: targ}] = true
+		}
+	}
+}
+
 // -- helpers ----------------------------------------------------------
 
 // recv returns the method's receiver.
@@ -833,9 +969,9 @@ func recv(meth *types.Func) *types.Var {
 }
 
 // someUse returns an arbitrary use of obj within info.
-func someUse(info *loader.PackageInfo, obj types.Object) *ast.Ident {
+func someUse(info *load.PackageInfo, obj types.Object) *ast.Ident {
 	for id, o := range info.Uses {
-		if o == obj {
+		if origin(o) == obj {
 			return id
 		}
 	}
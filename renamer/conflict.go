@@ -0,0 +1,180 @@
+package renamer
+
+// This file defines the conflicts rejecting a renaming.
+
+import (
+	"fmt"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// ConflictKind classifies the conflicts preventing a renaming.
+type ConflictKind uint8
+
+const (
+	// ConflictInvalid reports renamings that are invalid on their own,
+	// like renaming an object to an invalid name or renaming a built-in
+	// method.
+	ConflictInvalid ConflictKind = iota
+
+	// ConflictDeclaration reports a declaration of the new name in the
+	// same block, struct, interface or method set.
+	ConflictDeclaration
+
+	// ConflictShadowing reports a renamed object shadowing a reference to
+	// another object, or references to the renamed object becoming
+	// shadowed by another declaration.
+	ConflictShadowing
+
+	// ConflictSelection reports a field or method selection becoming
+	// ambiguous or changing its referent.
+	ConflictSelection
+
+	// ConflictMethodSet reports a method invoked via an interface becoming
+	// ambiguous or changing.
+	ConflictMethodSet
+
+	// ConflictSatisfaction reports a type no longer implementing an
+	// interface it is assigned to.
+	ConflictSatisfaction
+
+	// ConflictUnexport reports an object becoming unexported while being
+	// referenced by other packages.
+	ConflictUnexport
+
+	// ConflictImport reports a moved package no longer being importable
+	// by its importers.
+	ConflictImport
+
+	// ConflictMove reports a moved package conflicting with an existing
+	// package or directory.
+	ConflictMove
+
+	// ConflictProtected reports a renaming modifying a protected file.
+	ConflictProtected
+
+	// ConflictBatch reports an object renamed by more than one rename of a
+	// batch.
+	ConflictBatch
+
+	// ConflictBug reports an internal error of the renamer.
+	ConflictBug
+)
+
+var conflictKinds = [...]string{
+	ConflictInvalid:      "invalid",
+	ConflictDeclaration:  "declaration",
+	ConflictShadowing:    "shadowing",
+	ConflictSelection:    "selection",
+	ConflictMethodSet:    "method set",
+	ConflictSatisfaction: "satisfaction",
+	ConflictUnexport:     "unexport",
+	ConflictImport:       "import",
+	ConflictMove:         "move",
+	ConflictProtected:    "protected",
+	ConflictBatch:        "batch",
+	ConflictBug:          "bug",
+}
+
+func (k ConflictKind) String() string {
+	if int(k) < len(conflictKinds) {
+		return conflictKinds[k]
+	}
+	return fmt.Sprintf("ConflictKind(%d)", k)
+}
+
+// Conflict describes why a renaming has been rejected.
+type Conflict struct {
+	Kind ConflictKind
+
+	// Pos and Message describe the renaming rejected, e.g. `renaming this
+	// var "x" to "y"`.
+	Pos     token.Position
+	Message string
+
+	// Details explain the conflict, e.g. by pointing to the declaration
+	// of the new name.
+	Details []ConflictDetail
+
+	// Objects lists the objects involved, starting with the object
+	// renamed. Objects is empty if the conflict does not concern a
+	// single object, like moving a package.
+	Objects []types.Object
+}
+
+// ConflictDetail is a single line explaining a conflict.
+type ConflictDetail struct {
+	Pos     token.Position
+	Message string
+}
+
+// String formats the conflict like compiler errors, one line per detail.
+func (c Conflict) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%v: %v", c.Pos, c.Message)
+	for _, d := range c.Details {
+		fmt.Fprintf(&sb, "\n%v: \t%v", d.Pos, d.Message)
+	}
+	return sb.String()
+}
+
+// ConflictError is returned if a renaming is rejected. Conflicts holds all
+// conflicts found, in the order they have been detected.
+type ConflictError struct {
+	Conflicts []Conflict
+}
+
+// Error formats all conflicts, one line per conflict and detail.
+func (e *ConflictError) Error() string {
+	lines := make([]string, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		lines[i] = c.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// conflictError returns the conflicts as error, dropping duplicates. The
+// same conflict might be found once per package or file block.
+func conflictError(conflicts []Conflict) error {
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	var unique []Conflict
+	for _, c := range conflicts {
+		if s := c.String(); !seen[s] {
+			seen[s] = true
+			unique = append(unique, c)
+		}
+	}
+	return &ConflictError{Conflicts: unique}
+}
+
+// errorf reports a conflict and prevents file modification. The renamed
+// object from is nil if the conflict does not concern a single object.
+func (r *Renamer) errorf(kind ConflictKind, from types.Object, pos token.Pos, format string, args ...interface{}) {
+	c := Conflict{
+		Kind:    kind,
+		Pos:     r.iprog.Fset.Position(pos),
+		Message: fmt.Sprintf(format, args...),
+	}
+	if from != nil {
+		c.Objects = append(c.Objects, from)
+	}
+	r.conflicts = append(r.conflicts, c)
+}
+
+// detailf adds a detail to the last conflict reported. The object obj
+// involved in the conflict is optional.
+func (r *Renamer) detailf(obj types.Object, pos token.Pos, format string, args ...interface{}) {
+	c := &r.conflicts[len(r.conflicts)-1]
+	c.Details = append(c.Details, ConflictDetail{
+		Pos:     r.iprog.Fset.Position(pos),
+		Message: fmt.Sprintf(format, args...),
+	})
+	if obj != nil {
+		c.Objects = append(c.Objects, obj)
+	}
+}
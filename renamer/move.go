@@ -0,0 +1,320 @@
+package renamer
+
+// This file implements moving packages to a new import path.
+
+import (
+	"go/ast"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/urso/gotools/load"
+)
+
+// Mover moves a package and its subpackages to a new import path, like
+// gomvpkg. The import specs of all packages added to the mover are
+// rewritten to the new import paths. If the package is named after the last
+// element of its import path, the package is renamed after the last element
+// of the new import path, updating the package clauses and the qualified
+// references of all importers. Unlike renaming the package clause only,
+// importers whose new import name would conflict are reported, instead of
+// adding an import alias.
+type Mover struct {
+	r        *Renamer
+	from, to string // import paths
+	toDir    string
+
+	checked bool
+	err     error
+	imports []importMove
+	files   map[string]string // old file names -> new file names
+}
+
+type importMove struct {
+	spec *ast.ImportSpec
+	path string // new import path
+}
+
+// NewMover creates a mover changing the import path of the package from to
+// to. The files in the directory of the package are moved to toDir (see
+// filespec.MoveDir).
+func NewMover(prog *load.Program, from, to, toDir string) *Mover {
+	return &Mover{
+		r:     New(prog, ""),
+		from:  from,
+		to:    to,
+		toDir: toDir,
+		files: map[string]string{},
+	}
+}
+
+func (m *Mover) AddPackages(pkgs map[string]*load.PackageInfo) {
+	m.r.AddPackages(pkgs)
+}
+
+func (m *Mover) AddAllPackages(pkgs ...*load.PackageInfo) {
+	m.r.AddAllPackages(pkgs...)
+}
+
+func (m *Mover) AddPackage(info *load.PackageInfo) {
+	m.r.AddPackage(info)
+}
+
+// Protect registers a function checking whether a file may be modified.
+// See Renamer.Protect.
+func (m *Mover) Protect(fn func(filename string, file *ast.File) error) {
+	m.r.Protect(fn)
+}
+
+// Update checks and updates the program, returning the set of updated
+// files. The files to be moved are returned by Files.
+func (m *Mover) Update() (map[*token.File]bool, error) {
+	if err := m.Check(); err != nil {
+		return nil, err
+	}
+
+	files := m.r.doUpdate()
+	for _, imp := range m.imports {
+		// Replace the path within the quotes, unless the literal contains
+		// escape sequences.
+		spec := imp.spec
+		lit := spec.Path.Value
+		edit := Edit{
+			Pos:  spec.Path.Pos() + 1,
+			End:  spec.Path.End() - 1,
+			From: lit[1 : len(lit)-1],
+			To:   imp.path,
+			Text: imp.path,
+			Kind: "import path",
+		}
+		value := lit[:1] + imp.path + lit[:1]
+		if from, _ := strconv.Unquote(lit); from != edit.From {
+			value = strconv.Quote(imp.path)
+			edit.Pos, edit.End = spec.Path.Pos(), spec.Path.End()
+			edit.From, edit.Text = lit, value
+		}
+		m.r.edits = append(m.r.edits, edit)
+		spec.Path.Value = value
+		files[m.r.iprog.Fset.File(spec.Path.Pos())] = true
+	}
+	return files, nil
+}
+
+// Check performs the safety checks for moving the package without updating
+// the program. The conflicts found are returned as *ConflictError.
+func (m *Mover) Check() error {
+	if m.checked {
+		return m.err
+	}
+	m.checked = true
+
+	m.checkMove()
+	if len(m.r.conflicts) == 0 {
+		m.r.checkProtected()
+	}
+	m.err = conflictError(m.r.conflicts)
+	return m.err
+}
+
+// Edits returns the changes applied by Update, ordered by position. Edits
+// of files being moved refer to the original file names.
+func (m *Mover) Edits() []Edit {
+	return m.r.Edits()
+}
+
+// Files maps the names of all files being moved to their new names. Files
+// are moved with the package directory, including files not part of the
+// package, like testdata. Nested modules are not moved.
+func (m *Mover) Files() map[string]string {
+	return m.files
+}
+
+func (m *Mover) checkMove() {
+	r := m.r
+	info := r.iprog.Package(m.from)
+	if info == nil || len(info.Files) == 0 {
+		r.errorf(ConflictInvalid, nil, token.NoPos, "package %q has not been loaded", m.from)
+		return
+	}
+	pos := info.Files[0].Name.Pos()
+	fromDir := filepath.Dir(r.iprog.Fset.PositionFor(pos, false).Filename)
+
+	switch {
+	case m.from == m.to:
+		r.errorf(ConflictInvalid, nil, pos, "package %q is already located at %q", m.from, m.to)
+		return
+	case hasPathPrefix(m.to, m.from):
+		r.errorf(ConflictInvalid, nil, pos, "can not move package %q into its own subdirectory %q", m.from, m.to)
+		return
+	}
+	for pkg := range r.iprog.AllPackages {
+		if hasPathPrefix(pkg.Path(), m.to) && !hasPathPrefix(pkg.Path(), m.from) {
+			r.errorf(ConflictMove, nil, pos, "moving package %q to %q would conflict with package %q", m.from, m.to, pkg.Path())
+			return
+		}
+	}
+	if _, err := os.Stat(m.toDir); err == nil {
+		r.errorf(ConflictMove, nil, pos, "moving package %q to %q would conflict with directory %v", m.from, m.to, m.toDir)
+		return
+	}
+
+	// Rename the package if it is named after its import path.
+	if name := info.Pkg.Name(); name != "main" && name == pathName(m.from) {
+		if to := pathName(m.to); to != name && token.IsIdentifier(to) {
+			r.to = to
+			r.strictImports = true
+			r.check(PackageClause(info.Pkg))
+		}
+	}
+
+	// Files excluded by build constraints are moved as well, so their
+	// imports are updated, too.
+	for _, info := range r.sortedPackages() {
+		for _, files := range [][]*ast.File{info.Files, info.IgnoredFiles} {
+			for _, f := range files {
+				for _, spec := range f.Imports {
+					m.checkImport(info, spec)
+				}
+			}
+		}
+	}
+
+	if err := m.collectFiles(fromDir); err != nil {
+		r.errorf(ConflictMove, nil, pos, "moving package %q failed: %v", m.from, err)
+	}
+}
+
+// checkImport plans the update of an import of the moved package or one of
+// its subpackages.
+func (m *Mover) checkImport(info *load.PackageInfo, spec *ast.ImportSpec) {
+	from, err := strconv.Unquote(spec.Path.Value)
+	if err != nil || !hasPathPrefix(from, m.from) {
+		return
+	}
+	to := m.moved(from)
+
+	// External test packages are located in the directory of the package
+	// under test.
+	importer := strings.TrimSuffix(info.Pkg.Path(), "_test")
+	if hasPathPrefix(importer, m.from) {
+		importer = m.moved(importer)
+	}
+	if parent, ok := internalParent(to); ok && !hasPathPrefix(importer, parent) {
+		m.r.errorf(ConflictImport, nil, spec.Path.Pos(), "moving package %q to %q would make it internal to %q, not importable by %q",
+			from, to, parent, info.Pkg.Path())
+		return
+	}
+
+	m.r.checkFileProtected(spec.Path, "import path", from, to)
+	m.imports = append(m.imports, importMove{spec, to})
+}
+
+// moved returns the new import path of the moved package path.
+func (m *Mover) moved(path string) string {
+	return m.to + strings.TrimPrefix(path, m.from)
+}
+
+// collectFiles collects the files in dir, and the files of all packages
+// loaded from dir, to be moved to m.toDir.
+func (m *Mover) collectFiles(dir string) error {
+	move := func(filename string) error {
+		rel, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+		m.files[filename] = filepath.Join(m.toDir, rel)
+		return nil
+	}
+
+	err := filepath.Walk(dir, func(filename string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if filename == dir {
+				return nil
+			}
+			if name := fi.Name(); name == ".git" || name == ".hg" || name == ".svn" {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(filename, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return move(filename)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Files might only exist in the overlay.
+	for _, info := range m.r.iprog.AllPackages {
+		for _, f := range info.Files {
+			filename := m.r.iprog.Fset.PositionFor(f.Package, false).Filename
+			if _, ok := m.files[filename]; !ok && isBelow(dir, filename) {
+				if err := move(filename); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// pathName returns the last element of the import path, skipping major
+// version suffixes.
+func pathName(importPath string) string {
+	base := path.Base(importPath)
+	if dir := path.Dir(importPath); dir != "." && isMajorVersion(base) {
+		return path.Base(dir)
+	}
+	return base
+}
+
+func isMajorVersion(elem string) bool {
+	if len(elem) < 2 || elem[0] != 'v' {
+		return false
+	}
+	_, err := strconv.ParseUint(elem[1:], 10, 32)
+	return err == nil
+}
+
+// internalParent returns the import path prefix allowed to import the
+// package path, if path is internal.
+func internalParent(path string) (string, bool) {
+	switch {
+	case path == "internal" || strings.HasPrefix(path, "internal/"):
+		return "", true
+	case strings.HasSuffix(path, "/internal"):
+		return strings.TrimSuffix(path, "/internal"), true
+	}
+	if i := strings.LastIndex(path, "/internal/"); i >= 0 {
+		return path[:i], true
+	}
+	return "", false
+}
+
+// hasPathPrefix reports whether the import path p is prefix or located
+// below prefix.
+func hasPathPrefix(p, prefix string) bool {
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// isBelow reports whether filename is located in dir or its subdirectories,
+// skipping nested modules.
+func isBelow(dir, filename string) bool {
+	rel, err := filepath.Rel(dir, filename)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	for d := filepath.Dir(filename); d != dir && d != filepath.Dir(d); d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil {
+			return false
+		}
+	}
+	return true
+}
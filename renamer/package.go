@@ -0,0 +1,304 @@
+package renamer
+
+// This file implements the renaming of package clauses.
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+
+	"github.com/urso/gotools/load"
+)
+
+// packageRename holds the changes planned for renaming a package clause.
+type packageRename struct {
+	pkg     *types.Package
+	clauses []clauseRename
+	aliases []*ast.ImportSpec // implicit imports getting the old name as alias
+	removed []*ast.ImportSpec // explicit imports whose alias becomes the default name
+}
+
+type clauseRename struct {
+	id *ast.Ident
+	to string
+}
+
+// PackageClause returns the object denoting the package clause of pkg.
+// Passing the object to Check and Update renames the package in the
+// package clause of every file of the package, and in the files of its
+// external test package. Importers relying on the default package name are
+// updated. If the new name conflicts with another name in an importing
+// file, the old name is added as import alias instead. Import aliases equal
+// to the new name are removed.
+//
+// The object is a *types.PkgName importing its own package, which can not
+// occur in Go programs.
+func PackageClause(pkg *types.Package) types.Object {
+	return types.NewPkgName(token.NoPos, pkg, pkg.Name(), pkg)
+}
+
+func isPackageClause(obj types.Object) (*types.Package, bool) {
+	if pn, ok := obj.(*types.PkgName); ok && pn.Imported() == pn.Pkg() {
+		return pn.Pkg(), true
+	}
+	return nil, false
+}
+
+// checkPackageClause performs the safety checks for renaming the package
+// pkg, and plans the updates of all importers.
+func (r *Renamer) checkPackageClause(pkg *types.Package) {
+	from := pkg.Name()
+	info := r.iprog.AllPackages[pkg]
+	if info == nil || len(info.Files) == 0 {
+		r.errorf(ConflictInvalid, nil, token.NoPos, "package %q has not been loaded", pkg.Path())
+		return
+	}
+	pos := info.Files[0].Name.Pos()
+
+	if !token.IsIdentifier(r.to) || r.to == "_" {
+		r.errorf(ConflictInvalid, nil, pos, "%q is not a valid package name", r.to)
+		return
+	}
+	if from == "main" || r.to == "main" {
+		r.errorf(ConflictInvalid, nil, pos, "renaming package %q to %q would change whether the package is a command", from, r.to)
+		return
+	}
+	if from == r.to {
+		return
+	}
+
+	rename := &packageRename{pkg: pkg}
+	r.pkgRename = rename
+	for _, f := range info.Files {
+		rename.clauses = append(rename.clauses, clauseRename{f.Name, r.to})
+	}
+
+	// Rename the external test package along with the package.
+	if xtest := r.externalTest(pkg); xtest != nil && xtest.Pkg.Name() == from+"_test" {
+		for _, f := range xtest.Files {
+			rename.clauses = append(rename.clauses, clauseRename{f.Name, r.to + "_test"})
+		}
+	}
+
+	// Files excluded by build constraints are not type checked, but their
+	// package clauses must match the package in every build configuration.
+	for _, f := range info.IgnoredFiles {
+		switch f.Name.Name {
+		case from:
+			rename.clauses = append(rename.clauses, clauseRename{f.Name, r.to})
+		case from + "_test":
+			rename.clauses = append(rename.clauses, clauseRename{f.Name, r.to + "_test"})
+		}
+	}
+
+	for _, c := range rename.clauses {
+		r.checkFileProtected(c.id, "package", from, c.to)
+	}
+
+	// Update the importers.
+	for _, info := range r.sortedPackages() {
+		for _, f := range info.Files {
+			for _, spec := range f.Imports {
+				r.checkImport(rename, info, f, spec)
+			}
+		}
+		for _, f := range info.IgnoredFiles {
+			for _, spec := range f.Imports {
+				r.checkIgnoredImport(rename, spec)
+			}
+		}
+	}
+}
+
+// checkImport plans the update of a single import of the package renamed.
+func (r *Renamer) checkImport(rename *packageRename, info *load.PackageInfo, f *ast.File, spec *ast.ImportSpec) {
+	var obj types.Object
+	if spec.Name != nil {
+		obj = info.Defs[spec.Name]
+	} else {
+		obj = info.Implicits[spec]
+	}
+	pn, ok := obj.(*types.PkgName)
+	if !ok || pn.Imported() != rename.pkg {
+		return
+	}
+
+	if spec.Name != nil {
+		if spec.Name.Name == r.to {
+			rename.removed = append(rename.removed, spec)
+			r.checkFileProtected(spec.Name, "imported package name", spec.Name.Name, r.to)
+		}
+		return
+	}
+
+	if r.strictImports {
+		r.checkImportName(pn)
+		r.objsToUpdate[pn] = true
+		return
+	}
+	if r.importConflicts(info, f, pn) {
+		rename.aliases = append(rename.aliases, spec)
+		r.checkFileProtected(spec.Path, "imported package name", pn.Name(), r.to)
+		return
+	}
+	r.objsToUpdate[pn] = true
+}
+
+// checkIgnoredImport plans the update of an import of the package renamed
+// in a file excluded by build constraints. Without type information the
+// uses of the package name can not be renamed, so the old name is added as
+// import alias.
+func (r *Renamer) checkIgnoredImport(rename *packageRename, spec *ast.ImportSpec) {
+	path, err := strconv.Unquote(spec.Path.Value)
+	if err != nil || path != rename.pkg.Path() || spec.Name != nil {
+		return
+	}
+	rename.aliases = append(rename.aliases, spec)
+	r.checkFileProtected(spec.Path, "imported package name", rename.pkg.Name(), r.to)
+}
+
+// importConflicts reports whether the package name pn imported by f can
+// not be renamed to r.to.
+func (r *Renamer) importConflicts(info *load.PackageInfo, f *ast.File, pn *types.PkgName) bool {
+	// Conflicts with the package and file block.
+	if r.lookup(info.Pkg.Scope(), r.to) != nil {
+		return true
+	}
+	fileScope := info.Scopes[f]
+	if fileScope == nil || r.lookup(fileScope, r.to) != nil {
+		return true
+	}
+
+	universe := types.Universe.Lookup(r.to)
+	for id, obj := range info.Uses {
+		if id.Pos() < f.Pos() || id.Pos() > f.End() {
+			continue
+		}
+
+		// The new import name would shadow a predeclared object used in
+		// the file.
+		if universe != nil && obj == universe {
+			return true
+		}
+
+		// A local declaration would shadow the new import name.
+		if obj == pn {
+			scope := fileScope.Innermost(id.Pos())
+			if scope == nil {
+				continue
+			}
+			if _, other := r.lookupParent(scope, r.to, id.Pos()); other != nil && other.Parent() != types.Universe {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkFileProtected reports a conflict if the file declaring id must not be
+// modified.
+func (r *Renamer) checkFileProtected(id ast.Node, kind, name, to string) {
+	tokFile := r.iprog.Fset.File(id.Pos())
+	if tokFile == nil {
+		return
+	}
+	for _, info := range r.iprog.AllPackages {
+		for _, files := range [][]*ast.File{info.Files, info.IgnoredFiles} {
+			for _, f := range files {
+				if r.iprog.Fset.File(f.FileStart) != tokFile {
+					continue
+				}
+				for _, guard := range r.guards {
+					if err := guard(tokFile.Name(), f); err != nil {
+						r.errorf(ConflictProtected, nil, id.Pos(), "renaming this %s %q to %q would modify a protected file",
+							kind, name, to)
+						r.detailf(nil, id.Pos(), "%v", err)
+						return
+					}
+				}
+				return
+			}
+		}
+	}
+}
+
+// externalTest returns the external test package of pkg, if loaded.
+func (r *Renamer) externalTest(pkg *types.Package) *load.PackageInfo {
+	for p, info := range r.iprog.AllPackages {
+		if p.Path() == pkg.Path()+"_test" {
+			return info
+		}
+	}
+	return nil
+}
+
+func (r *Renamer) sortedPackages() []*load.PackageInfo {
+	infos := make([]*load.PackageInfo, 0, len(r.packages))
+	for _, info := range r.packages {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Pkg.Path() < infos[j].Pkg.Path()
+	})
+	return infos
+}
+
+// updatePackageClause applies the planned package rename to the syntax
+// trees.
+func (r *Renamer) updatePackageClause(filesToUpdate map[*token.File]bool) {
+	rename := r.pkgRename
+	if rename == nil {
+		return
+	}
+	from := rename.pkg.Name()
+	file := func(pos token.Pos) {
+		filesToUpdate[r.iprog.Fset.File(pos)] = true
+	}
+
+	for _, c := range rename.clauses {
+		r.edits = append(r.edits, Edit{
+			Pos:  c.id.Pos(),
+			End:  c.id.End(),
+			From: c.id.Name,
+			To:   c.to,
+			Text: c.to,
+			Kind: "package",
+		})
+		c.id.Name = c.to
+		file(c.id.Pos())
+	}
+
+	// Insert the old name as import alias.
+	for _, spec := range rename.aliases {
+		pos := spec.Path.Pos()
+		r.edits = append(r.edits, Edit{
+			Pos:  pos,
+			End:  pos,
+			To:   from,
+			Text: from + " ",
+			Kind: "imported package name",
+		})
+		spec.Name = &ast.Ident{NamePos: pos, Name: from}
+		file(pos)
+	}
+
+	// Remove aliases matching the new package name, including the
+	// separating white space.
+	for _, spec := range rename.removed {
+		name := spec.Name
+		r.edits = append(r.edits, Edit{
+			Pos:  name.Pos(),
+			End:  name.End(),
+			From: name.Name,
+			Kind: "imported package name",
+		}, Edit{
+			Pos:  name.End(),
+			End:  spec.Path.Pos(),
+			Kind: "imported package name",
+		})
+		spec.Name = nil
+		file(spec.Path.Pos())
+	}
+}
@@ -1,61 +1,89 @@
 package renamer
 
 import (
-	"errors"
-	"fmt"
+	"go/ast"
 	"go/token"
 	"go/types"
-	"os"
+	"sort"
 
-	"golang.org/x/tools/go/loader"
 	"golang.org/x/tools/go/types/typeutil"
 	"golang.org/x/tools/refactor/satisfy"
+
+	"github.com/urso/gotools/load"
 )
 
 // renamer extracted from gorename
 
 type Renamer struct {
-	iprog              *loader.Program
+	iprog              *load.Program
 	objsToUpdate       map[types.Object]bool
-	hadConflicts       bool
+	conflicts          []Conflict
 	to                 string
 	satisfyConstraints map[satisfy.Constraint]bool
-	packages           map[*types.Package]*loader.PackageInfo // subset of iprog.AllPackages to inspect
+	packages           map[*types.Package]*load.PackageInfo // subset of iprog.AllPackages to inspect
 	msets              typeutil.MethodSetCache
 	changeMethods      bool
+	guards             []func(filename string, file *ast.File) error
+	edits              []Edit
+	pkgRename          *packageRename
+	strictImports      bool   // report import name conflicts instead of adding aliases
+	batch              *Batch // renames checked along with this one, if any
 }
 
-var ReportError = func(posn token.Position, message string) {
-	fmt.Fprintf(os.Stderr, "%s: %s\n", posn, message)
+// Edit describes a single change applied by Update. Most edits rename an
+// identifier, replacing the range [Pos, End) with Text. Renaming a package
+// may also insert (Pos == End) or remove (empty Text) import aliases.
+type Edit struct {
+	Pos, End token.Pos // position of the original text
+	From, To string    // old and new name
+	Text     string    // replacement text
+	Kind     string    // kind of the renamed object (e.g. "func", "field")
 }
 
-func New(prog *loader.Program, to string) *Renamer {
+func New(prog *load.Program, to string) *Renamer {
 	return &Renamer{
 		iprog:        prog,
 		objsToUpdate: map[types.Object]bool{},
 		to:           to,
-		packages:     map[*types.Package]*loader.PackageInfo{},
+		packages:     map[*types.Package]*load.PackageInfo{},
 	}
 }
 
-func (r *Renamer) AddPackages(pkgs map[string]*loader.PackageInfo) {
+func (r *Renamer) AddPackages(pkgs map[string]*load.PackageInfo) {
 	for _, info := range pkgs {
 		r.AddPackage(info)
 	}
 }
 
-func (r *Renamer) AddAllPackages(pkgs ...*loader.PackageInfo) {
+func (r *Renamer) AddAllPackages(pkgs ...*load.PackageInfo) {
 	for _, info := range pkgs {
 		r.AddPackage(info)
 	}
 }
 
-func (r *Renamer) AddPackage(info *loader.PackageInfo) {
+func (r *Renamer) AddPackage(info *load.PackageInfo) {
 	r.packages[info.Pkg] = info
 }
 
+// Protect registers a function checking whether a file may be modified.
+// If fn returns an error for any file the renaming would modify, the
+// renaming is reported as conflict.
+func (r *Renamer) Protect(fn func(filename string, file *ast.File) error) {
+	r.guards = append(r.guards, fn)
+}
+
 // update checks and updates the input program returning the set of updated files.
 func (r *Renamer) Update(objs ...types.Object) (map[*token.File]bool, error) {
+	if err := r.Check(objs...); err != nil {
+		return nil, err
+	}
+	return r.doUpdate(), nil
+}
+
+// Check performs the safety checks for renaming objs without updating the
+// program. The conflicts found are returned as *ConflictError. Update can be
+// called with the same objects after Check.
+func (r *Renamer) Check(objs ...types.Object) error {
 	for _, obj := range objs {
 		if obj, ok := obj.(*types.Func); ok {
 			recv := obj.Type().(*types.Signature).Recv()
@@ -69,11 +97,10 @@ func (r *Renamer) Update(objs ...types.Object) (map[*token.File]bool, error) {
 	for _, obj := range objs {
 		r.check(obj)
 	}
-	if r.hadConflicts {
-		return nil, errors.New("Conflicts detected")
+	if len(r.conflicts) == 0 {
+		r.checkProtected()
 	}
-
-	return r.doUpdate(), nil
+	return conflictError(r.conflicts)
 }
 
 func (r *Renamer) doUpdate() map[*token.File]bool {
@@ -85,20 +112,49 @@ func (r *Renamer) doUpdate() map[*token.File]bool {
 	for _, info := range r.packages {
 		// Mutate the ASTs and note the filenames.
 		for id, obj := range info.Defs {
-			if r.objsToUpdate[obj] {
+			if r.objsToUpdate[origin(obj)] {
 				nidents++
-				id.Name = r.to
+				r.rename(id, obj)
 				filesToUpdate[r.iprog.Fset.File(id.Pos())] = true
 			}
 		}
 		for id, obj := range info.Uses {
-			if r.objsToUpdate[obj] {
+			// The identifier of an embedded field both defines the field
+			// and uses the embedded type. Rename it once.
+			if def := info.Defs[id]; def != nil && r.objsToUpdate[origin(def)] {
+				continue
+			}
+			if r.objsToUpdate[origin(obj)] {
 				nidents++
-				id.Name = r.to
+				r.rename(id, obj)
 				filesToUpdate[r.iprog.Fset.File(id.Pos())] = true
 			}
 		}
 	}
+	r.updatePackageClause(filesToUpdate)
 
 	return filesToUpdate
 }
+
+func (r *Renamer) rename(id *ast.Ident, obj types.Object) {
+	r.edits = append(r.edits, Edit{
+		Pos:  id.Pos(),
+		End:  id.End(),
+		From: id.Name,
+		To:   r.to,
+		Text: r.to,
+		Kind: objectKind(obj),
+	})
+	id.Name = r.to
+}
+
+// Edits returns the identifiers renamed by Update, ordered by position.
+// Files parsed more than once, e.g. as part of a package and its test
+// variant, report the same identifier once per parsed file.
+func (r *Renamer) Edits() []Edit {
+	edits := append([]Edit(nil), r.edits...)
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].Pos < edits[j].Pos
+	})
+	return edits
+}
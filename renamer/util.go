@@ -21,11 +21,48 @@ func isLocal(obj types.Object) bool {
 	return depth >= 4
 }
 
+// origin returns the generic object obj has been instantiated from. Fields
+// and methods of instantiated types, and instantiated functions, are
+// distinct objects from the fields and methods declared in the source.
+func origin(obj types.Object) types.Object {
+	switch obj := obj.(type) {
+	case *types.Func:
+		return obj.Origin()
+	case *types.Var:
+		return obj.Origin()
+	}
+	return obj
+}
+
+// isTypeParam reports whether obj declares a type parameter.
+func isTypeParam(obj types.Object) bool {
+	if obj, ok := obj.(*types.TypeName); ok {
+		_, ok := obj.Type().(*types.TypeParam)
+		return ok
+	}
+	return false
+}
+
+// typeParams returns the type parameters of the generic type or function
+// obj.
+func typeParams(obj types.Object) *types.TypeParamList {
+	switch t := obj.Type().(type) {
+	case *types.Named:
+		return t.TypeParams()
+	case *types.Signature:
+		return t.TypeParams()
+	}
+	return nil
+}
+
 func objectKind(obj types.Object) string {
 	switch obj := obj.(type) {
 	case *types.PkgName:
 		return "imported package name"
 	case *types.TypeName:
+		if isTypeParam(obj) {
+			return "type parameter"
+		}
 		return "type"
 	case *types.Var:
 		if obj.IsField() {
@@ -0,0 +1,303 @@
+package workspace
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/refactor/importgraph"
+)
+
+// indexVersion is stored with every index. Indexes written with another
+// version are discarded.
+const indexVersion = 1
+
+// Index is a persistent cache of the imports of all packages in a
+// workspace, for a single build context. The index is stored in the user
+// cache directory. Packages are only scanned again if one of their Go files
+// has been added, removed or modified since the last update.
+type Index struct {
+	// File is the cache file the index is stored in. File is empty if no
+	// user cache directory is available.
+	File string
+
+	// Packages maps package directories to their index entries.
+	Packages map[string]*IndexEntry
+
+	ctx   *build.Context
+	ws    *Workspace
+	dirty bool
+}
+
+// IndexEntry records the imports of the package in a single directory.
+type IndexEntry struct {
+	Path    string               // import path
+	Files   map[string]FileStamp // Go files in the directory by base name
+	Imports []string             // imports including test imports, excluding "C"
+	Error   string               // error reported while scanning the package
+}
+
+// FileStamp identifies the version of a file the index entry has been
+// created from.
+type FileStamp struct {
+	ModTime int64 // modification time in nanoseconds
+	Size    int64
+}
+
+type indexFile struct {
+	Version  int
+	Packages map[string]*IndexEntry
+}
+
+// OpenIndex reads the index of the workspace ws for the build context ctx
+// from the user cache directory. If ws is nil, the $GOPATH workspace of ctx
+// is indexed. A missing or unreadable index is replaced by an empty one. Use
+// Update to bring the index up to date with the workspace.
+func OpenIndex(ctx *build.Context, ws *Workspace) *Index {
+	if ws == nil {
+		ws = gopathWorkspace(ctx)
+	}
+
+	idx := &Index{
+		File:     indexFileName(ctx, ws),
+		Packages: map[string]*IndexEntry{},
+		ctx:      ctx,
+		ws:       ws,
+	}
+	if idx.File == "" {
+		return idx
+	}
+
+	data, err := ioutil.ReadFile(idx.File)
+	if err != nil {
+		return idx
+	}
+
+	// A broken index is rebuilt.
+	var f indexFile
+	if err := json.Unmarshal(data, &f); err == nil && f.Version == indexVersion && f.Packages != nil {
+		idx.Packages = f.Packages
+	}
+	return idx
+}
+
+// indexFileName returns the cache file name for the workspace and build
+// context.
+func indexFileName(ctx *build.Context, ws *Workspace) string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "workspace %v\n", ws.File)
+	for _, m := range ws.Modules {
+		fmt.Fprintf(h, "module %v %v\n", m.Path, m.Dir)
+	}
+	fmt.Fprintf(h, "goroot %v\ngopath %v\n", ctx.GOROOT, ctx.GOPATH)
+	fmt.Fprintf(h, "goos %v\ngoarch %v\ncgo %v\ncompiler %v\n",
+		ctx.GOOS, ctx.GOARCH, ctx.CgoEnabled, ctx.Compiler)
+	fmt.Fprintf(h, "tags %v\nreleasetags %v\ntooltags %v\n",
+		strings.Join(ctx.BuildTags, ","),
+		strings.Join(ctx.ReleaseTags, ","),
+		strings.Join(ctx.ToolTags, ","))
+
+	name := hex.EncodeToString(h.Sum(nil))[:32] + ".json"
+	return filepath.Join(cacheDir, "gotools", "importindex", name)
+}
+
+// Update scans all packages in the workspace that have changed since the
+// index has been updated last. Update returns the number of packages
+// scanned or removed from the index.
+func (idx *Index) Update() int {
+	updated := 0
+	packages := map[string]*IndexEntry{}
+	for _, m := range idx.ws.Modules {
+		for dir, files := range goFiles(m.Dir) {
+			rel, _ := RelPath(m.Dir, dir)
+			if m.Path == "" && rel == "." {
+				continue // $GOPATH/src is no package
+			}
+			pkgPath := path.Join(m.Path, filepath.ToSlash(rel))
+
+			if e := idx.Packages[dir]; e != nil && e.Path == pkgPath && sameFiles(e.Files, files) {
+				packages[dir] = e
+				continue
+			}
+
+			packages[dir] = scanDir(idx.ctx, dir, pkgPath, files)
+			updated++
+		}
+	}
+	for dir := range idx.Packages {
+		if packages[dir] == nil {
+			updated++
+		}
+	}
+
+	idx.Packages = packages
+	if updated > 0 {
+		idx.dirty = true
+	}
+	return updated
+}
+
+// Reset removes all entries from the index, such that the next Update scans
+// all packages.
+func (idx *Index) Reset() {
+	idx.Packages = map[string]*IndexEntry{}
+	idx.dirty = true
+}
+
+// Save writes the index to the user cache directory, if the index has been
+// modified.
+func (idx *Index) Save() error {
+	if idx.File == "" || !idx.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(indexFile{Version: indexVersion, Packages: idx.Packages})
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(idx.File)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so concurrent runs never read a
+	// partially written index.
+	tmp, err := ioutil.TempFile(dir, filepath.Base(idx.File)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), idx.File)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	idx.dirty = false
+	return nil
+}
+
+// Graph returns the forward import graph of all packages in the index, and
+// the errors reported while scanning them.
+func (idx *Index) Graph() (importgraph.Graph, map[string]error) {
+	graph := importgraph.Graph{}
+	var errs map[string]error
+	for _, e := range idx.Packages {
+		for _, imp := range e.Imports {
+			addEdge(graph, e.Path, imp)
+		}
+		if e.Error != "" {
+			if errs == nil {
+				errs = map[string]error{}
+			}
+			errs[e.Path] = errors.New(e.Error)
+		}
+	}
+	return graph, errs
+}
+
+// scanDir collects the imports of the package in dir.
+func scanDir(ctx *build.Context, dir, pkgPath string, files map[string]FileStamp) *IndexEntry {
+	e := &IndexEntry{Path: pkgPath, Files: files}
+
+	bp, err := ctx.ImportDir(dir, 0)
+	if err != nil {
+		if _, ok := err.(*build.NoGoError); !ok {
+			e.Error = err.Error()
+		}
+		// Even in error cases, ImportDir usually returns a package.
+	}
+	if bp == nil {
+		return e
+	}
+
+	seen := map[string]bool{}
+	for _, imps := range [][]string{bp.Imports, bp.TestImports, bp.XTestImports} {
+		for _, imp := range imps {
+			if imp != "C" && !seen[imp] { // "C" is fake
+				seen[imp] = true
+				e.Imports = append(e.Imports, imp)
+			}
+		}
+	}
+	sort.Strings(e.Imports)
+	return e
+}
+
+// goFiles returns the Go files in all directories of a module that might
+// contain packages. Nested modules, testdata and vendor directories are
+// skipped.
+func goFiles(root string) map[string]map[string]FileStamp {
+	dirs := map[string]map[string]FileStamp{}
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if !fi.IsDir() {
+			if strings.HasSuffix(path, ".go") {
+				dir, name := filepath.Split(path)
+				dir = filepath.Clean(dir)
+				files := dirs[dir]
+				if files == nil {
+					files = map[string]FileStamp{}
+					dirs[dir] = files
+				}
+				files[name] = FileStamp{ModTime: fi.ModTime().UnixNano(), Size: fi.Size()}
+			}
+			return nil
+		}
+
+		if path != root && skipDir(path) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return dirs
+}
+
+func sameFiles(a, b map[string]FileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, stamp := range a {
+		if other, exists := b[name]; !exists || other != stamp {
+			return false
+		}
+	}
+	return true
+}
+
+// gopathWorkspace returns a pseudo workspace for the $GOPATH source
+// directories of ctx. $GOROOT is not included, as it never imports
+// workspace packages.
+func gopathWorkspace(ctx *build.Context) *Workspace {
+	ws := &Workspace{}
+	goroot := filepath.Join(ctx.GOROOT, "src")
+	for _, dir := range ctx.SrcDirs() {
+		if dir != goroot {
+			ws.Modules = append(ws.Modules, Module{Dir: dir})
+		}
+	}
+	return ws
+}
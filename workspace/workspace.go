@@ -0,0 +1,275 @@
+// Package workspace discovers the modules of the workspace enclosing a
+// directory and scans them for import relationships.
+//
+// A workspace is either declared by a go.work file, or consists of the
+// single module enclosing the directory. Directories not part of any module
+// fall back to $GOPATH.
+//
+// The imports found are stored in a persistent index in the user cache
+// directory, such that only packages changed since the last scan need to be
+// parsed again.
+package workspace
+
+import (
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/go/buildutil"
+	"golang.org/x/tools/refactor/importgraph"
+
+	"github.com/urso/gotools/load"
+)
+
+// Workspace is the set of main modules to analyze.
+type Workspace struct {
+	// File is the go.work file declaring the workspace. File is empty if the
+	// workspace consists of a single module.
+	File string
+
+	Modules []Module
+}
+
+// Module is a main module of the workspace.
+type Module struct {
+	Path string // module path
+	Dir  string // directory containing go.mod
+}
+
+// Find returns the workspace enclosing dir. The go.work file is searched
+// for in dir and its parent directories, unless GOWORK is set. If no go.work
+// file is found, the workspace consists of the module enclosing dir. Find
+// returns nil if dir is not part of a module.
+func Find(dir string) (*Workspace, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	gowork := os.Getenv("GOWORK")
+	switch gowork {
+	case "off":
+	case "":
+		if found := FindFile(dir, "go.work"); found != "" {
+			return readWork(found)
+		}
+	default:
+		return readWork(gowork)
+	}
+
+	gomod := FindFile(dir, "go.mod")
+	if gomod == "" {
+		return nil, nil
+	}
+	m, err := readModule(filepath.Dir(gomod))
+	if err != nil {
+		return nil, err
+	}
+	return &Workspace{Modules: []Module{m}}, nil
+}
+
+func readWork(gowork string) (*Workspace, error) {
+	data, err := ioutil.ReadFile(gowork)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := modfile.ParseWork(gowork, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ws := &Workspace{File: gowork}
+	for _, use := range f.Use {
+		dir := filepath.FromSlash(use.Path)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(gowork), dir)
+		}
+
+		m, err := readModule(filepath.Clean(dir))
+		if err != nil {
+			return nil, err
+		}
+		ws.Modules = append(ws.Modules, m)
+	}
+	return ws, nil
+}
+
+func readModule(dir string) (Module, error) {
+	gomod := filepath.Join(dir, "go.mod")
+	data, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		return Module{}, err
+	}
+
+	modPath := modfile.ModulePath(data)
+	if modPath == "" {
+		return Module{}, fmt.Errorf("%v: missing module directive", gomod)
+	}
+	return Module{Path: modPath, Dir: dir}, nil
+}
+
+// Root returns the root directory of the workspace, which is the directory
+// of the go.work file, or of the single module.
+func (ws *Workspace) Root() string {
+	if ws.File != "" {
+		return filepath.Dir(ws.File)
+	}
+	return ws.Modules[0].Dir
+}
+
+// Module returns the workspace module containing the directory dir.
+func (ws *Workspace) Module(dir string) (Module, bool) {
+	var best Module
+	found := false
+	for _, m := range ws.Modules {
+		if _, ok := RelPath(m.Dir, dir); ok && len(m.Dir) > len(best.Dir) {
+			best, found = m, true
+		}
+	}
+	return best, found
+}
+
+// Build returns the forward and reverse import graphs of all packages in the
+// workspace enclosing dir, like importgraph.Build. Imports are collected for
+// every build configuration given, such that packages only imported by files
+// excluded from the default build are still found. If dir is not part of a
+// module, the $GOPATH workspace of ctx is used instead.
+//
+// The imports are read from the persistent index of the workspace (see
+// Index), which is updated for packages changed since the last run. Packages
+// with files in overlay are scanned with the overlay contents, without
+// storing these in the index.
+func Build(
+	ctx *build.Context,
+	dir string,
+	configs []load.BuildConfig,
+	overlay map[string][]byte,
+) (forward, reverse importgraph.Graph, errors map[string]error) {
+	if dir == "" {
+		dir = "."
+	}
+	if len(configs) == 0 {
+		configs = []load.BuildConfig{{}}
+	}
+
+	ws, err := Find(dir)
+	if err != nil {
+		return nil, nil, map[string]error{dir: err}
+	}
+
+	addError := func(path string, err error) {
+		if errors == nil {
+			errors = map[string]error{}
+		}
+		errors[path] = err
+	}
+
+	forward = importgraph.Graph{}
+	reverse = importgraph.Graph{}
+	for _, c := range configs {
+		cctx := c.Context(ctx)
+		idx := OpenIndex(cctx, ws)
+		idx.Update()
+		if err := idx.Save(); err != nil {
+			addError(idx.File, err)
+		}
+
+		fwd, errs := idx.Graph()
+		if len(overlay) > 0 {
+			octx := buildutil.OverlayContext(cctx, overlay)
+			for dir := range overlayDirs(overlay) {
+				e := idx.Packages[dir]
+				if e == nil {
+					continue
+				}
+
+				e = scanDir(octx, dir, e.Path, e.Files)
+				delete(fwd, e.Path)
+				delete(errs, e.Path)
+				for _, imp := range e.Imports {
+					addEdge(fwd, e.Path, imp)
+				}
+				if e.Error != "" {
+					if errs == nil {
+						errs = map[string]error{}
+					}
+					errs[e.Path] = fmt.Errorf("%v", e.Error)
+				}
+			}
+		}
+
+		for from, tos := range fwd {
+			for to := range tos {
+				addEdge(forward, from, to)
+				addEdge(reverse, to, from)
+			}
+		}
+		for path, err := range errs {
+			addError(path, err)
+		}
+	}
+	return forward, reverse, errors
+}
+
+func overlayDirs(overlay map[string][]byte) map[string]bool {
+	dirs := map[string]bool{}
+	for filename := range overlay {
+		dirs[filepath.Dir(filename)] = true
+	}
+	return dirs
+}
+
+// skipDir checks if the directory cannot contain packages of the enclosing
+// module. Hidden directories, testdata, vendor and nested modules are
+// skipped.
+func skipDir(dir string) bool {
+	_, elem := filepath.Split(dir)
+	if strings.HasPrefix(elem, ".") || strings.HasPrefix(elem, "_") ||
+		elem == "testdata" || elem == "vendor" {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(dir, "go.mod"))
+	return err == nil
+}
+
+// FindFile searches dir and its parent directories for a regular file with
+// the given name, like go.mod. FindFile returns an empty string if the file
+// is not found.
+func FindFile(dir, name string) string {
+	for {
+		file := filepath.Join(dir, name)
+		if fi, err := os.Stat(file); err == nil && !fi.IsDir() {
+			return file
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func addEdge(g importgraph.Graph, from, to string) {
+	edges := g[from]
+	if edges == nil {
+		edges = map[string]bool{}
+		g[from] = edges
+	}
+	edges[to] = true
+}
+
+// RelPath returns path relative to root if path is root or located below
+// root.
+func RelPath(root, path string) (string, bool) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
@@ -0,0 +1,198 @@
+package write
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stagedFile is the new content of a file written to a temporary file in
+// the same directory, ready to be renamed over the original file.
+type stagedFile struct {
+	filename string // target file, with symlinks resolved
+	tmp      string
+	remove   bool     // file is removed on commit
+	dirs     []string // directories created for the file
+
+	// original content and mode, used to restore the file
+	exists bool
+	kept   bool // orig has been read
+	orig   []byte
+	mode   os.FileMode
+}
+
+// writeFileAtomic replaces the contents of filename with content. The
+// content is written to a temporary file in the same directory first, which
+// is synced and renamed over the original file. This way filename either
+// holds the old or the new content, even if the process is interrupted. The
+// mode and, if permitted, the ownership of the original file are preserved.
+func writeFileAtomic(filename string, content []byte) error {
+	staged, err := stageFile(filename, content, false, 0644)
+	if err != nil {
+		return err
+	}
+	if err := staged.commit(); err != nil {
+		staged.discard()
+		removeEmptyDirs(staged.dirs)
+		return err
+	}
+	return nil
+}
+
+// stageFile writes content to a synced temporary file next to filename. If
+// keepOrig is set, the original content is read for restoring the file
+// later on. New files are created with mode. Missing directories of new
+// files are created and recorded, such that they can be removed if the
+// file is not written after all.
+func stageFile(filename string, content []byte, keepOrig bool, mode os.FileMode) (*stagedFile, error) {
+	// Replace the target of symlinks, not the link itself.
+	if resolved, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = resolved
+	}
+
+	staged := &stagedFile{filename: filename, mode: mode}
+	fi, err := os.Stat(filename)
+	if err == nil {
+		staged.exists = true
+		staged.mode = fi.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if keepOrig && staged.exists {
+		if staged.orig, err = ioutil.ReadFile(filename); err != nil {
+			return nil, err
+		}
+		staged.kept = true
+	}
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	if !staged.exists {
+		staged.dirs = missingDirs(dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			removeEmptyDirs(staged.dirs)
+			return nil, err
+		}
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base+".*.tmp")
+	if err != nil {
+		removeEmptyDirs(staged.dirs)
+		return nil, err
+	}
+	staged.tmp = tmp.Name()
+
+	err = tmp.Chmod(staged.mode)
+	if err == nil {
+		if fi != nil {
+			chown(tmp, fi)
+		}
+		_, err = tmp.Write(content)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(staged.tmp)
+		removeEmptyDirs(staged.dirs)
+		return nil, err
+	}
+	return staged, nil
+}
+
+// missingDirs returns dir and its parents not existing yet.
+func missingDirs(dir string) []string {
+	var dirs []string
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dirs
+		}
+		dirs = append(dirs, dir)
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dirs
+		}
+		dir = parent
+	}
+}
+
+// stageRemove prepares the removal of filename, keeping the original
+// content and mode for restoring the file.
+func stageRemove(filename string) (*stagedFile, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	orig, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &stagedFile{
+		filename: filename,
+		remove:   true,
+		exists:   true,
+		kept:     true,
+		orig:     orig,
+		mode:     fi.Mode().Perm(),
+	}, nil
+}
+
+// commit renames the temporary file over the original file, or removes the
+// original file. If the original content has been kept, commit refuses to
+// replace the file with ErrModified if it has been modified since it has
+// been staged. A modification in the short window between this check and
+// the rename is not detected, as the file system provides no means to
+// replace a file only if it is unchanged.
+func (s *stagedFile) commit() error {
+	if s.kept {
+		current, err := ioutil.ReadFile(s.filename)
+		switch {
+		case os.IsNotExist(err):
+			return ErrModified
+		case err != nil:
+			return err
+		case !bytes.Equal(current, s.orig):
+			return ErrModified
+		}
+	}
+
+	if s.remove {
+		return os.Remove(s.filename)
+	}
+	if err := os.Rename(s.tmp, s.filename); err != nil {
+		return err
+	}
+	s.tmp = ""
+	return nil
+}
+
+// discard removes the temporary file if it has not been committed.
+func (s *stagedFile) discard() {
+	if s.tmp != "" {
+		os.Remove(s.tmp)
+		s.tmp = ""
+	}
+}
+
+// restore reverts a committed file to its original content, or removes it
+// if it did not exist before.
+func (s *stagedFile) restore() error {
+	if !s.exists {
+		return os.Remove(s.filename)
+	}
+
+	if s.remove {
+		if err := writeFileAtomic(s.filename, s.orig); err != nil {
+			return err
+		}
+		return os.Chmod(s.filename, s.mode)
+	}
+
+	// The committed file kept the original mode.
+	return writeFileAtomic(s.filename, s.orig)
+}
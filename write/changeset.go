@@ -0,0 +1,227 @@
+package write
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ChangeSet maps file names to their new contents. Files mapped to nil are
+// removed. Files not existing yet are created.
+type ChangeSet map[string][]byte
+
+// Remove records the removal of filename.
+func (cs ChangeSet) Remove(filename string) {
+	cs[filename] = nil
+}
+
+// Move records moving the file from to the file to. The content moved is
+// the new content of from if from is part of the change set already, or the
+// original content read from overlay or disk otherwise.
+func (cs ChangeSet) Move(overlay map[string][]byte, from, to string) error {
+	content, changed := cs[from]
+	if !changed {
+		var err error
+		if content, err = readOrig(overlay, from); err != nil {
+			return err
+		}
+	}
+	if content == nil {
+		return fmt.Errorf("can not move %v: file is removed", from)
+	}
+	cs[to] = content
+	cs.Remove(from)
+	return nil
+}
+
+// Files returns the names of all files in the change set in sorted order.
+func (cs ChangeSet) Files() []string {
+	files := make([]string, 0, len(cs))
+	for file := range cs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// FileModes maps the names of files created by a change set to their
+// permission bits. Files not found are created with mode 0644.
+type FileModes map[string]os.FileMode
+
+// Move records the file to being created with the mode of the file from.
+// The default mode is kept if from only exists in the overlay.
+func (fm FileModes) Move(from, to string) error {
+	fi, err := os.Stat(from)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fm[to] = fi.Mode().Perm()
+	return nil
+}
+
+// mode returns the mode of the new file filename.
+func (fm FileModes) mode(filename string) os.FileMode {
+	if mode, ok := fm[filename]; ok {
+		return mode
+	}
+	return 0644
+}
+
+// ChangeSetWriter is implemented by writers able to apply a change set
+// all-or-nothing.
+type ChangeSetWriter interface {
+	WriteAll(changes ChangeSet) error
+}
+
+// FileError reports the failure to write a single file.
+type FileError struct {
+	Filename string
+	Err      error
+}
+
+// ApplyError lists the files a change set could not be applied to. If the
+// change set has been rolled back, RestoreFailed lists the files that could
+// not be restored to their original contents.
+type ApplyError struct {
+	Failed        []FileError
+	RestoreFailed []FileError
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Filename, e.Err)
+}
+
+func (e *ApplyError) Error() string {
+	var msgs []string
+	for _, f := range e.Failed {
+		msgs = append(msgs, f.Error())
+	}
+	msg := fmt.Sprintf("failed to write %v file(s): %v", len(e.Failed), strings.Join(msgs, "; "))
+
+	if len(e.RestoreFailed) > 0 {
+		msgs = msgs[:0]
+		for _, f := range e.RestoreFailed {
+			msgs = append(msgs, f.Error())
+		}
+		msg += fmt.Sprintf("; failed to restore %v file(s): %v", len(e.RestoreFailed), strings.Join(msgs, "; "))
+	}
+	return msg
+}
+
+// WriteAll writes all files in changes. If w implements ChangeSetWriter,
+// the change set is applied all-or-nothing. Otherwise every file is passed
+// to w.Write, and the files that failed are reported in an *ApplyError.
+func WriteAll(w Writer, changes ChangeSet) error {
+	if csw, ok := w.(ChangeSetWriter); ok {
+		return csw.WriteAll(changes)
+	}
+
+	var failed []FileError
+	for _, file := range changes.Files() {
+		if err := w.Write(file, changes[file]); err != nil {
+			failed = append(failed, FileError{file, err})
+		}
+	}
+	if len(failed) > 0 {
+		return &ApplyError{Failed: failed}
+	}
+	return nil
+}
+
+// applyChangeSet writes all files in changes, or none. Every file is staged
+// in a temporary file first. Once all files have been staged, the temporary
+// files are renamed over the originals, and removed files are deleted. If
+// staging or renaming fails for any file, all files already renamed or
+// deleted are restored to their original contents, and the directories
+// created for new files are removed again. Directories left empty by
+// removing files are deleted as well, but not their parents.
+//
+// If verify is not nil, it is passed the original contents of all existing
+// files as read for staging. The change set is refused if verify fails for
+// any file. New files are created with the mode found in modes.
+func applyChangeSet(changes ChangeSet, modes FileModes, verify func(filename string, orig []byte) error) error {
+	var staged []*stagedFile
+	var failed []FileError
+	for _, file := range changes.Files() {
+		var s *stagedFile
+		var err error
+		if content := changes[file]; content == nil {
+			s, err = stageRemove(file)
+		} else {
+			s, err = stageFile(file, content, true, modes.mode(file))
+		}
+		if err == nil && verify != nil && s.exists {
+			if err = verify(file, s.orig); err != nil {
+				s.discard()
+				removeEmptyDirs(s.dirs)
+			}
+		}
+		if err != nil {
+			failed = append(failed, FileError{file, err})
+			continue
+		}
+		staged = append(staged, s)
+	}
+
+	discard := func() {
+		var created []string
+		for _, s := range staged {
+			s.discard()
+			created = append(created, s.dirs...)
+		}
+		removeEmptyDirs(created)
+	}
+	if len(failed) > 0 {
+		discard()
+		return &ApplyError{Failed: failed}
+	}
+
+	for i, s := range staged {
+		if err := s.commit(); err != nil {
+			restoreFailed := rollback(staged[:i])
+			discard()
+			return &ApplyError{
+				Failed:        []FileError{{s.filename, err}},
+				RestoreFailed: restoreFailed,
+			}
+		}
+	}
+
+	var dirs []string
+	for _, s := range staged {
+		if s.remove {
+			dirs = append(dirs, filepath.Dir(s.filename))
+		}
+	}
+	removeEmptyDirs(dirs)
+	return nil
+}
+
+// removeEmptyDirs removes the directories dirs if they are empty. Nested
+// directories are removed before their parents.
+func removeEmptyDirs(dirs []string) {
+	sorted := append([]string(nil), dirs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	for _, dir := range sorted {
+		os.Remove(dir)
+	}
+}
+
+// rollback restores the committed files in reverse order.
+func rollback(committed []*stagedFile) []FileError {
+	var failed []FileError
+	for i := len(committed) - 1; i >= 0; i-- {
+		s := committed[i]
+		if err := s.restore(); err != nil {
+			failed = append(failed, FileError{s.filename, err})
+		}
+	}
+	return failed
+}
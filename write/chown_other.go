@@ -0,0 +1,8 @@
+//go:build !unix
+
+package write
+
+import "os"
+
+// chown is a no-op on systems without unix file ownership.
+func chown(f *os.File, fi os.FileInfo) {}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package write
+
+import (
+	"os"
+	"syscall"
+)
+
+// chown tries to transfer the ownership of the original file fi to f.
+// Failures are ignored, as only privileged users can change the owner.
+func chown(f *os.File, fi os.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		f.Chown(int(st.Uid), int(st.Gid))
+	}
+}
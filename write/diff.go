@@ -0,0 +1,422 @@
+package write
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DiffOptions configures the built-in unified diff writer.
+type DiffOptions struct {
+	// Context is the number of unchanged lines shown around changes.
+	Context int
+
+	// Color highlights the diff using ANSI escape sequences.
+	Color bool
+
+	// Root is the directory file names are reported relative to. If empty,
+	// the current working directory is used.
+	Root string
+
+	// Overlay holds the original contents of files not saved to disk yet.
+	Overlay map[string][]byte
+
+	// Hashes adds 'index' lines holding the git blob hashes of the original
+	// and new content of every file.
+	Hashes bool
+
+	// Modes holds the modes of files created. Modes can be filled after
+	// the writer has been created.
+	Modes FileModes
+}
+
+type unifiedDiffWriter struct {
+	out  io.Writer
+	opts DiffOptions
+}
+
+const (
+	colorReset = "\x1b[0m"
+	colorBold  = "\x1b[1m"
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorCyan  = "\x1b[36m"
+)
+
+// NewUnifiedDiffWriter creates a writer printing the changes to out as
+// unified diff, instead of modifying any file. File names use the 'a/' and
+// 'b/' prefixes, such that the output can be applied with 'git apply' or
+// 'patch -p1' from the root directory. Change sets are printed in file name
+// order.
+func NewUnifiedDiffWriter(out io.Writer, opts DiffOptions) Writer {
+	return &unifiedDiffWriter{out: out, opts: opts}
+}
+
+func (w *unifiedDiffWriter) Write(filename string, content []byte) error {
+	mode := w.opts.Modes.mode(filename)
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	orig, exists := w.opts.Overlay[filename]
+	if !exists {
+		var err error
+		orig, err = ioutil.ReadFile(filename)
+		if err == nil {
+			exists = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	writeUnifiedDiff(&buf, w.displayName(filename), orig, exists, content, mode, w.opts)
+	_, err := w.out.Write(buf.Bytes())
+	return err
+}
+
+func (w *unifiedDiffWriter) WriteAll(changes ChangeSet) error {
+	var failed []FileError
+	for _, file := range changes.Files() {
+		if err := w.Write(file, changes[file]); err != nil {
+			failed = append(failed, FileError{file, err})
+		}
+	}
+	if len(failed) > 0 {
+		return &ApplyError{Failed: failed}
+	}
+	return nil
+}
+
+// displayName returns the slash separated path of filename relative to the
+// root directory, or the absolute path if filename is not located below
+// root.
+func (w *unifiedDiffWriter) displayName(filename string) string {
+	root := w.opts.Root
+	if root == "" {
+		root, _ = os.Getwd()
+	}
+
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return filepath.ToSlash(filename)
+	}
+	if rel, err := filepath.Rel(root, abs); err == nil && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(rel)
+	}
+	return strings.TrimPrefix(filepath.ToSlash(abs), "/")
+}
+
+// UnifiedDiff writes the unified diff between orig and content of the file
+// name to out. Nothing is written if the contents are equal.
+func UnifiedDiff(out io.Writer, name string, orig, content []byte, opts DiffOptions) error {
+	bw := bufio.NewWriter(out)
+	writeUnifiedDiff(bw, name, orig, true, content, 0644, opts)
+	return bw.Flush()
+}
+
+// gitMode returns the git mode of a regular file with the permission bits
+// of mode. Git only distinguishes executable and non-executable files.
+func gitMode(mode os.FileMode) string {
+	if mode&0111 != 0 {
+		return "100755"
+	}
+	return "100644"
+}
+
+type lineWriter interface {
+	io.Writer
+	io.StringWriter
+}
+
+// writeUnifiedDiff writes the diff of a single file. The file is created
+// if orig does not exist, and removed if content is nil. Mode is the mode
+// of the file created or removed.
+func writeUnifiedDiff(out lineWriter, name string, orig []byte, exists bool, content []byte, mode os.FileMode, opts DiffOptions) {
+	removed := content == nil
+	if (exists && !removed && bytes.Equal(orig, content)) || (!exists && removed) {
+		return
+	}
+
+	a, b := splitLines(orig), splitLines(content)
+	edits := diffLines(a, b)
+
+	color := func(c, s string) string {
+		if !opts.Color {
+			return s
+		}
+		return c + s + colorReset
+	}
+
+	from := "a/" + name
+	if !exists {
+		from = "/dev/null"
+	}
+	to := "b/" + name
+	if removed {
+		to = "/dev/null"
+	}
+	out.WriteString(color(colorBold, fmt.Sprintf("diff --git a/%v b/%v", name, name)) + "\n")
+	if !exists {
+		out.WriteString(color(colorBold, "new file mode "+gitMode(mode)) + "\n")
+	}
+	if removed {
+		out.WriteString(color(colorBold, "deleted file mode "+gitMode(mode)) + "\n")
+	}
+	if opts.Hashes {
+		origHash, newHash := nullHash, nullHash
+		if exists {
+			origHash = blobHash(orig)
+		}
+		if !removed {
+			newHash = blobHash(content)
+		}
+		out.WriteString(color(colorBold, fmt.Sprintf("index %v..%v", origHash, newHash)) + "\n")
+	}
+	out.WriteString(color(colorBold, "--- "+from) + "\n")
+	out.WriteString(color(colorBold, "+++ "+to) + "\n")
+
+	ctx := opts.Context
+	if ctx < 0 {
+		ctx = 0
+	}
+	for _, h := range hunks(edits, ctx) {
+		aStart, aLen, bStart, bLen := h[0].a, 0, h[0].b, 0
+		for _, e := range h {
+			switch e.kind {
+			case opEqual:
+				aLen++
+				bLen++
+			case opDelete:
+				aLen++
+			case opInsert:
+				bLen++
+			}
+		}
+		// Line numbers start at 1. Empty ranges name the line preceding
+		// the change.
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		out.WriteString(color(colorCyan, fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aLen, bStart, bLen)) + "\n")
+
+		for _, e := range h {
+			switch e.kind {
+			case opEqual:
+				writeDiffLine(out, " ", a[e.a], "", opts.Color)
+			case opDelete:
+				writeDiffLine(out, "-", a[e.a], colorRed, opts.Color)
+			case opInsert:
+				writeDiffLine(out, "+", b[e.b], colorGreen, opts.Color)
+			}
+		}
+	}
+}
+
+func writeDiffLine(out lineWriter, prefix, line, c string, color bool) {
+	text := strings.TrimSuffix(line, "\n")
+	if color && c != "" {
+		out.WriteString(c + prefix + text + colorReset + "\n")
+	} else {
+		out.WriteString(prefix + text + "\n")
+	}
+	if !strings.HasSuffix(line, "\n") {
+		out.WriteString("\\ No newline at end of file\n")
+	}
+}
+
+// splitLines splits content into lines, keeping the line terminators.
+func splitLines(content []byte) []string {
+	var lines []string
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n')
+		if i < 0 {
+			lines = append(lines, string(content))
+			break
+		}
+		lines = append(lines, string(content[:i+1]))
+		content = content[i+1:]
+	}
+	return lines
+}
+
+type opKind uint8
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+// edit is a single step of an edit script. a and b are the indexes of the
+// lines in the original and new content at the position of the edit.
+type edit struct {
+	kind opKind
+	a, b int
+}
+
+// hunks groups the changes of the edit script into hunks, with up to ctx
+// unchanged lines around every change. Changes separated by at most 2*ctx
+// unchanged lines are merged into a single hunk.
+func hunks(edits []edit, ctx int) [][]edit {
+	var result [][]edit
+	end := 0
+	for i := 0; i < len(edits); {
+		for i < len(edits) && edits[i].kind == opEqual {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+
+		start := i - ctx
+		if start < end {
+			start = end
+		}
+
+		last := i
+		for j := i; j < len(edits); j++ {
+			if edits[j].kind != opEqual {
+				last = j
+			} else if j-last > 2*ctx {
+				break
+			}
+		}
+
+		end = last + ctx + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+		result = append(result, edits[start:end])
+		i = end
+	}
+	return result
+}
+
+// diffLines computes the shortest edit script transforming a into b, using
+// the algorithm described in "An O(ND) Difference Algorithm and Its
+// Variations" by Eugene W. Myers.
+func diffLines(a, b []string) []edit {
+	// Common prefix and suffix lines are not part of the search.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var edits []edit
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, edit{opEqual, i, i})
+	}
+	for _, e := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		e.a += prefix
+		e.b += prefix
+		edits = append(edits, e)
+	}
+	for i := suffix; i > 0; i-- {
+		edits = append(edits, edit{opEqual, len(a) - i, len(b) - i})
+	}
+	return edits
+}
+
+func myers(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+
+	// Files being created or removed need no search.
+	var edits []edit
+	switch {
+	case n == 0:
+		for y := 0; y < m; y++ {
+			edits = append(edits, edit{opInsert, 0, y})
+		}
+		return edits
+	case m == 0:
+		for x := 0; x < n; x++ {
+			edits = append(edits, edit{opDelete, x, 0})
+		}
+		return edits
+	}
+
+	// v[offset+k] holds the furthest x reached on diagonal k. trace holds
+	// the diagonals -d..d of v before every step d, for backtracking the
+	// path. Only these diagonals are read when backtracking step d.
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	d := 0
+search:
+	for ; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // insertion, move down
+			} else {
+				x = v[offset+k-1] + 1 // deletion, move right
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Backtrack from (n, m), collecting the edits in reverse order.
+	x, y := n, m
+	for ; d > 0; d-- {
+		v := trace[d] // v[d+k] holds diagonal k
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[d+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, edit{opEqual, x, y})
+		}
+		if x == prevX {
+			y--
+			edits = append(edits, edit{opInsert, x, y})
+		} else {
+			x--
+			edits = append(edits, edit{opDelete, x, y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		edits = append(edits, edit{opEqual, x, y})
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
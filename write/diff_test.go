@@ -0,0 +1,171 @@
+package write
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	cases := []struct {
+		a, b    string
+		changes int // minimal number of lines deleted and inserted
+	}{
+		{"", "", 0},
+		{"a\n", "a\n", 0},
+		{"", "a\nb\n", 2},
+		{"a\nb\n", "", 2},
+		{"a\nb\nc\n", "a\nc\n", 1},
+		{"a\nc\n", "a\nb\nc\n", 1},
+		{"a\nb\nc\n", "a\nx\nc\n", 2},
+		{"a\nb\nc\nd\n", "d\nc\nb\na\n", 6},
+		{"a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n", 5},
+		{"a", "a\n", 2},
+	}
+	for _, c := range cases {
+		a, b := splitLines([]byte(c.a)), splitLines([]byte(c.b))
+		edits := diffLines(a, b)
+
+		var got []string
+		changes := 0
+		for _, e := range edits {
+			switch e.kind {
+			case opEqual:
+				if a[e.a] != b[e.b] {
+					t.Errorf("diff(%q, %q): line %v and %v are not equal", c.a, c.b, e.a, e.b)
+				}
+				got = append(got, a[e.a])
+			case opDelete:
+				changes++
+			case opInsert:
+				got = append(got, b[e.b])
+				changes++
+			}
+		}
+		if s := strings.Join(got, ""); s != c.b {
+			t.Errorf("diff(%q, %q) produces %q", c.a, c.b, s)
+		}
+		if changes != c.changes {
+			t.Errorf("diff(%q, %q) changes %v lines, want %v", c.a, c.b, changes, c.changes)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	cases := []struct {
+		name     string
+		orig     string
+		content  string
+		context  int
+		expected string
+	}{
+		{
+			name:     "equal",
+			orig:     "a\nb\n",
+			content:  "a\nb\n",
+			context:  3,
+			expected: "",
+		},
+		{
+			name:    "change",
+			orig:    "a\nb\nc\nd\ne\n",
+			content: "a\nb\nx\nd\ne\n",
+			context: 1,
+			expected: `diff --git a/f.go b/f.go
+--- a/f.go
++++ b/f.go
+@@ -2,3 +2,3 @@
+ b
+-c
++x
+ d
+`,
+		},
+		{
+			name:    "hunks",
+			orig:    "1\n2\n3\n4\n5\n6\n7\n8\n",
+			content: "0\n2\n3\n4\n5\n6\n7\n9\n",
+			context: 1,
+			expected: `diff --git a/f.go b/f.go
+--- a/f.go
++++ b/f.go
+@@ -1,2 +1,2 @@
+-1
++0
+ 2
+@@ -7,2 +7,2 @@
+ 7
+-8
++9
+`,
+		},
+		{
+			name:    "insert at start",
+			orig:    "a\n",
+			content: "x\na\n",
+			context: 0,
+			expected: `diff --git a/f.go b/f.go
+--- a/f.go
++++ b/f.go
+@@ -0,0 +1,1 @@
++x
+`,
+		},
+		{
+			name:    "no newline at end of file",
+			orig:    "a\nb",
+			content: "a\nc",
+			context: 3,
+			expected: `diff --git a/f.go b/f.go
+--- a/f.go
++++ b/f.go
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++c
+\ No newline at end of file
+`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := UnifiedDiff(&buf, "f.go", []byte(c.orig), []byte(c.content), DiffOptions{Context: c.context})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != c.expected {
+				t.Errorf("unexpected diff:\n%s\nwant:\n%s", got, c.expected)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiffCreateRemove(t *testing.T) {
+	var buf bytes.Buffer
+	writeUnifiedDiff(&buf, "f.go", nil, false, []byte("a\n"), 0644, DiffOptions{Context: 3})
+	expected := `diff --git a/f.go b/f.go
+new file mode 100644
+--- /dev/null
++++ b/f.go
+@@ -0,0 +1,1 @@
++a
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("unexpected diff creating file:\n%s\nwant:\n%s", got, expected)
+	}
+
+	buf.Reset()
+	writeUnifiedDiff(&buf, "f.go", []byte("a\n"), true, nil, 0755, DiffOptions{Context: 3})
+	expected = `diff --git a/f.go b/f.go
+deleted file mode 100755
+--- a/f.go
++++ /dev/null
+@@ -1,1 +0,0 @@
+-a
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("unexpected diff removing file:\n%s\nwant:\n%s", got, expected)
+	}
+}
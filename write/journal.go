@@ -0,0 +1,253 @@
+package write
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Journal records the changes applied by a single run, such that the run
+// can be undone later on.
+type Journal struct {
+	// ID names the journal within the journal directory. The ID is assigned
+	// when the journal is saved.
+	ID string
+
+	Time    time.Time
+	Renames []Rename
+	Files   []JournalFile
+	Dirs    []string // directories created by the run
+
+	dir string
+}
+
+// Rename records a renamed identifier.
+type Rename struct {
+	Position string // declaration of the renamed object
+	From, To string
+}
+
+// JournalFile records the original and new content of a changed file. The
+// original hash and content are empty if the file has been created, the new
+// hash and content are empty if the file has been removed.
+type JournalFile struct {
+	Filename string
+	OrigHash string
+	NewHash  string
+	Orig     []byte
+	New      []byte
+}
+
+const journalExt = ".json"
+
+// JournalDir returns the journal directory of the workspace in root.
+func JournalDir(root string) string {
+	return filepath.Join(root, ".gotools", "journal")
+}
+
+// NewJournal creates a journal to be stored in dir.
+func NewJournal(dir string) *Journal {
+	return &Journal{dir: dir}
+}
+
+// AddRename records the renaming of the object declared at pos.
+func (j *Journal) AddRename(pos token.Position, from, to string) {
+	j.Renames = append(j.Renames, Rename{Position: pos.String(), From: from, To: to})
+}
+
+// Writer returns a writer recording all changes written to w in the
+// journal. The journal is saved once a change set has been written
+// successfully.
+func (j *Journal) Writer(w Writer) Writer {
+	return &journalWriter{j: j, w: w}
+}
+
+type journalWriter struct {
+	j *Journal
+	w Writer
+}
+
+func (jw *journalWriter) Write(filename string, content []byte) error {
+	return jw.WriteAll(ChangeSet{filename: content})
+}
+
+func (jw *journalWriter) WriteAll(changes ChangeSet) error {
+	var files []JournalFile
+	var dirs []string
+	created := map[string]bool{}
+	for _, filename := range changes.Files() {
+		f := JournalFile{Filename: filename, New: changes[filename]}
+		if f.New != nil {
+			f.NewHash = hashContent(f.New)
+		}
+
+		orig, err := ioutil.ReadFile(filename)
+		if err == nil {
+			f.Orig = orig
+			f.OrigHash = hashContent(orig)
+		} else if !os.IsNotExist(err) {
+			return &ApplyError{Failed: []FileError{{filename, err}}}
+		} else if f.New != nil {
+			for _, dir := range missingDirs(filepath.Dir(filename)) {
+				if !created[dir] {
+					created[dir] = true
+					dirs = append(dirs, dir)
+				}
+			}
+		}
+		files = append(files, f)
+	}
+
+	if err := WriteAll(jw.w, changes); err != nil {
+		return err
+	}
+
+	jw.j.Files = append(jw.j.Files, files...)
+	jw.j.Dirs = append(jw.j.Dirs, dirs...)
+	if err := jw.j.Save(); err != nil {
+		return fmt.Errorf("files have been written, but saving the undo journal failed: %v", err)
+	}
+	return nil
+}
+
+// Save writes the journal to its directory.
+func (j *Journal) Save() error {
+	if j.dir == "" {
+		return errors.New("no journal directory configured")
+	}
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		return err
+	}
+
+	// Keep journals out of version control.
+	ignore := filepath.Join(filepath.Dir(j.dir), ".gitignore")
+	if _, err := os.Stat(ignore); os.IsNotExist(err) {
+		ioutil.WriteFile(ignore, []byte("*\n"), 0644)
+	}
+
+	if j.ID == "" {
+		j.Time = time.Now()
+		j.ID = fmt.Sprintf("%v-%d", j.Time.UTC().Format("20060102T150405.000000000"), os.Getpid())
+	}
+
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(j.dir, j.ID+journalExt), data)
+}
+
+// Journals returns the IDs of all journals in dir, oldest first.
+func Journals(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ids []string
+	for _, fi := range fis {
+		if name := fi.Name(); !fi.IsDir() && strings.HasSuffix(name, journalExt) {
+			ids = append(ids, strings.TrimSuffix(name, journalExt))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ReadJournal reads the journal id from dir. If id is empty, the most
+// recent journal is read.
+func ReadJournal(dir, id string) (*Journal, error) {
+	if id == "" {
+		ids, err := Journals(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("no journal found in %v", dir)
+		}
+		id = ids[len(ids)-1]
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, id+journalExt))
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{dir: dir}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("invalid journal %v: %v", id, err)
+	}
+	j.ID = id
+	return j, nil
+}
+
+// Undo restores the original contents of all files changed in the run
+// recorded by the journal, and removes the journal. Files created by the run
+// are removed, files removed are restored. Directories created by the run
+// are removed if empty. Undo refuses to modify any file if one of the files
+// has been changed since the run.
+func (j *Journal) Undo() error {
+	var changed []FileError
+	restore := ChangeSet{}
+	for _, f := range j.Files {
+		current, err := ioutil.ReadFile(f.Filename)
+		switch {
+		case f.NewHash == "" && err == nil:
+			changed = append(changed, FileError{f.Filename, errors.New("file has been recreated since the run")})
+			continue
+		case f.NewHash == "" && os.IsNotExist(err):
+			// removed by the run
+		case err != nil:
+			changed = append(changed, FileError{f.Filename, err})
+			continue
+		case hashContent(current) != f.NewHash:
+			changed = append(changed, FileError{f.Filename, errors.New("file has been changed since the run")})
+			continue
+		}
+
+		if f.OrigHash == "" {
+			restore.Remove(f.Filename)
+			continue
+		}
+		if hashContent(f.Orig) != f.OrigHash {
+			return fmt.Errorf("journal %v is corrupted: invalid original content of %v", j.ID, f.Filename)
+		}
+		restore[f.Filename] = f.Orig
+	}
+	if len(changed) > 0 {
+		return &ApplyError{Failed: changed}
+	}
+
+	if err := applyChangeSet(restore, nil, nil); err != nil {
+		return err
+	}
+	removeEmptyDirs(j.Dirs)
+	return os.Remove(filepath.Join(j.dir, j.ID+journalExt))
+}
+
+// Undo undoes the run recorded by the journal id in dir. If id is empty,
+// the most recent run is undone. The journal undone is returned.
+func Undo(dir, id string) (*Journal, error) {
+	j, err := ReadJournal(dir, id)
+	if err != nil {
+		return nil, err
+	}
+	return j, j.Undo()
+}
+
+func hashContent(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,331 @@
+package write
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Edit replaces the bytes [Offset, End) of a file with NewText. The
+// remaining fields describe the rename the edit is part of.
+type Edit struct {
+	Filename    string
+	Offset, End int
+	NewText     string
+
+	OldName, NewName string
+	Kind             string // kind of the renamed object (e.g. "func", "field")
+	Reason           string // why the object is renamed (e.g. lint message)
+}
+
+// TextEdit is an LSP style text edit, extended by the rename metadata.
+type TextEdit struct {
+	File    string `json:"file"`
+	Range   Range  `json:"range"`
+	NewText string `json:"newText"`
+
+	OldName string `json:"oldName,omitempty"`
+	NewName string `json:"newName,omitempty"`
+	Kind    string `json:"kind,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+
+	// Create is set if the file is created with NewText as its content.
+	// Delete is set if the file is removed. Range is empty for both.
+	Create bool `json:"create,omitempty"`
+	Delete bool `json:"delete,omitempty"`
+}
+
+// Range is a LSP range. The end position is exclusive.
+type Range struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// Position is a LSP position. Line and Character are zero based, with
+// Character counting UTF-16 code units.
+type Position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// JSONWriter prints the recorded edits as JSON array of
+// TextEdits, instead of modifying any file. Files in a change set without
+// any recorded edit are replaced as a whole. Files created or removed by
+// the change set are reported as a single TextEdit with Create or Delete
+// set. The white space realigned by Splice is reported by additional
+// TextEdits without rename metadata.
+type JSONWriter struct {
+	out     io.Writer
+	overlay map[string][]byte
+	edits   EditSet
+}
+
+// NewJSONWriter creates a JSON writer printing the edits in es to out.
+// Positions of files found in overlay are computed based on the overlay
+// contents.
+func NewJSONWriter(out io.Writer, overlay map[string][]byte, es EditSet) *JSONWriter {
+	if es == nil {
+		es = EditSet{}
+	}
+	return &JSONWriter{out: out, overlay: overlay, edits: es}
+}
+
+// AddEdit records an edit to be printed once its file is written.
+func (w *JSONWriter) AddEdit(e Edit) {
+	w.edits.Add(e)
+}
+
+func (w *JSONWriter) Write(filename string, content []byte) error {
+	return w.WriteAll(ChangeSet{filename: content})
+}
+
+func (w *JSONWriter) WriteAll(changes ChangeSet) error {
+	textEdits := []TextEdit{}
+	var failed []FileError
+	for _, filename := range changes.Files() {
+		edits, err := w.fileEdits(filename, changes[filename])
+		if err != nil {
+			failed = append(failed, FileError{filename, err})
+			continue
+		}
+		textEdits = append(textEdits, edits...)
+	}
+	if len(failed) > 0 {
+		return &ApplyError{Failed: failed}
+	}
+
+	data, err := json.MarshalIndent(textEdits, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.out.Write(append(data, '\n'))
+	return err
+}
+
+func (w *JSONWriter) fileEdits(filename string, content []byte) ([]TextEdit, error) {
+	if content == nil {
+		return []TextEdit{{File: filename, Delete: true}}, nil
+	}
+
+	orig, err := readOrig(w.overlay, filename)
+	if os.IsNotExist(err) {
+		return []TextEdit{{File: filename, NewText: string(content), Create: true}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	edits := w.edits[filename]
+	if len(edits) == 0 {
+		return []TextEdit{{
+			File:    filename,
+			Range:   Range{Start: Position{}, End: offsetPosition(orig, len(orig))},
+			NewText: string(content),
+		}}, nil
+	}
+
+	edits, err = normalizeEdits(orig, edits)
+	if err != nil {
+		return nil, err
+	}
+	if spliced, _, _ := splice(orig, edits); !bytes.Equal(spliced, content) {
+		edits = realignEdits(orig, edits, spliced, content)
+	}
+
+	var result []TextEdit
+	for _, e := range edits {
+		result = append(result, TextEdit{
+			File: filename,
+			Range: Range{
+				Start: offsetPosition(orig, e.Offset),
+				End:   offsetPosition(orig, e.End),
+			},
+			NewText: e.NewText,
+			OldName: e.OldName,
+			NewName: e.NewName,
+			Kind:    e.Kind,
+			Reason:  e.Reason,
+		})
+	}
+	return result, nil
+}
+
+// realignEdits returns the edits transforming orig into content, with
+// content being the result of splicing the edits into orig and realigning
+// it (see Splice). The edits are complemented by edits of the white space
+// realigned. Lines changed otherwise by gofmt are replaced as a whole,
+// keeping the rename metadata only if all edits replaced belong to the
+// same rename.
+func realignEdits(orig []byte, edits []Edit, spliced, content []byte) []Edit {
+	origLines, a, b := splitLines(orig), splitLines(spliced), splitLines(content)
+	if len(origLines) != len(a) {
+		// Edits adding or removing lines are not realigned.
+		return []Edit{{Offset: 0, End: len(orig), NewText: string(content)}}
+	}
+
+	starts := make([]int, len(origLines)+1)
+	for i, line := range origLines {
+		starts[i+1] = starts[i] + len(line)
+	}
+	lineEdits := make([][]Edit, len(origLines))
+	line := 0
+	for _, e := range edits {
+		for line+1 < len(origLines) && starts[line+1] <= e.Offset {
+			line++
+		}
+		lineEdits[line] = append(lineEdits[line], e)
+	}
+
+	var result []Edit
+	ops := diffLines(a, b)
+	for i := 0; i < len(ops); {
+		if ops[i].kind == opEqual {
+			result = append(result, lineEdits[ops[i].a]...)
+			i++
+			continue
+		}
+
+		j := i
+		var deleted, inserted []int
+		for ; j < len(ops) && ops[j].kind != opEqual; j++ {
+			if ops[j].kind == opDelete {
+				deleted = append(deleted, ops[j].a)
+			} else {
+				inserted = append(inserted, ops[j].b)
+			}
+		}
+
+		var changed []Edit
+		ok := len(deleted) == len(inserted)
+		for k := 0; ok && k < len(deleted); k++ {
+			l := deleted[k]
+			var lineChanges []Edit
+			lineChanges, ok = realignLine(starts[l], lineEdits[l], a[l], b[inserted[k]])
+			changed = append(changed, lineChanges...)
+		}
+		if !ok {
+			first := ops[i].a
+			var text strings.Builder
+			var replaced []Edit
+			for _, l := range inserted {
+				text.WriteString(b[l])
+			}
+			for _, l := range deleted {
+				replaced = append(replaced, lineEdits[l]...)
+			}
+			e := commonRename(replaced)
+			e.Offset, e.End, e.NewText = starts[first], starts[first+len(deleted)], text.String()
+			changed = []Edit{e}
+		}
+		result = append(result, changed...)
+		i = j
+	}
+	return result
+}
+
+// realignLine returns the edits of a single line starting at offset start
+// in the original content, complemented by the edits changing the white
+// space of the spliced line to the formatted line. realignLine fails if
+// the lines differ in more than white space between the same tokens.
+func realignLine(start int, edits []Edit, spliced, formatted string) ([]Edit, bool) {
+	// origin maps the bytes of the spliced line to their offsets in the
+	// original content, or -1 if inserted by an edit.
+	origin := make([]int, 0, len(spliced))
+	offset := start
+	for _, e := range edits {
+		for ; offset < e.Offset; offset++ {
+			origin = append(origin, offset)
+		}
+		for range []byte(e.NewText) {
+			origin = append(origin, -1)
+		}
+		offset = e.End
+	}
+	for len(origin) < len(spliced) {
+		origin = append(origin, offset)
+		offset++
+	}
+
+	x, y := splitSpace(spliced), splitSpace(formatted)
+	if len(x) != len(y) {
+		return nil, false
+	}
+	result := append([]Edit(nil), edits...)
+	for k := range x {
+		from, to := spliced[x[k].start:x[k].end], formatted[y[k].start:y[k].end]
+		if from == to {
+			continue
+		}
+		if !x[k].space || !y[k].space {
+			return nil, false
+		}
+
+		first, last := origin[x[k].start], origin[x[k].end-1]
+		if first < 0 || last-first != x[k].end-1-x[k].start {
+			return nil, false
+		}
+		result = append(result, Edit{Offset: first, End: last + 1, NewText: to})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Offset < result[j].Offset
+	})
+	return result, true
+}
+
+type textRun struct {
+	start, end int
+	space      bool
+}
+
+// splitSpace splits line into alternating runs of blanks and other
+// characters.
+func splitSpace(line string) []textRun {
+	var runs []textRun
+	for i := 0; i < len(line); {
+		space := line[i] == ' ' || line[i] == '\t'
+		j := i + 1
+		for j < len(line) && (line[j] == ' ' || line[j] == '\t') == space {
+			j++
+		}
+		runs = append(runs, textRun{i, j, space})
+		i = j
+	}
+	return runs
+}
+
+// commonRename returns an edit holding the rename metadata shared by all
+// edits, or no metadata if the edits belong to different renames.
+func commonRename(edits []Edit) Edit {
+	var e Edit
+	for i, other := range edits {
+		meta := Edit{OldName: other.OldName, NewName: other.NewName, Kind: other.Kind, Reason: other.Reason}
+		if i == 0 {
+			e = meta
+		} else if e != meta {
+			return Edit{}
+		}
+	}
+	return e
+}
+
+// offsetPosition converts the byte offset in content into a LSP position.
+func offsetPosition(content []byte, offset int) Position {
+	var pos Position
+	for i := 0; i < offset; {
+		r, n := utf8.DecodeRune(content[i:])
+		i += n
+		if r == '\n' {
+			pos.Line++
+			pos.Character = 0
+		} else if r >= 0x10000 {
+			pos.Character += 2
+		} else {
+			pos.Character++
+		}
+	}
+	return pos
+}
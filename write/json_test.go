@@ -0,0 +1,126 @@
+package write
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONWriterRealign(t *testing.T) {
+	cases := []struct {
+		name    string
+		src     string
+		marker  string
+		from    string
+		to      string
+		renames int // number of edits with rename metadata
+	}{
+		{
+			name: "aligned struct field",
+			src: `package p
+
+type T struct {
+	A   int // a
+	Bcd int // bcd
+}
+`,
+			marker:  "Bcd int",
+			from:    "Bcd",
+			to:      "B",
+			renames: 1,
+		},
+		{
+			name: "sorted imports",
+			src: `package p
+
+import (
+	"a"
+	"c"
+	"d"
+)
+`,
+			marker:  `"d"`,
+			from:    "d",
+			to:      "b",
+			renames: 1,
+		},
+		{
+			name: "no realignment",
+			src: `package p
+
+func F() int { return 1 }
+`,
+			marker:  "func",
+			from:    "F",
+			to:      "Get",
+			renames: 1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := rename(t, c.src, c.marker, c.from, c.to)
+			e.Filename = "/a.go"
+			overlay := map[string][]byte{"/a.go": []byte(c.src)}
+			edits := EditSet{}
+			edits.Add(e)
+
+			changes, err := edits.Apply(overlay, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			if err := NewJSONWriter(&buf, overlay, edits).WriteAll(changes); err != nil {
+				t.Fatal(err)
+			}
+			var textEdits []TextEdit
+			if err := json.Unmarshal(buf.Bytes(), &textEdits); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, expected := applyTextEdits(t, c.src, textEdits), string(changes["/a.go"]); got != expected {
+				t.Errorf("text edits produce:\n%s\nwant:\n%s", got, expected)
+			}
+			renames := 0
+			for _, te := range textEdits {
+				if te.OldName != "" {
+					renames++
+					if te.OldName != c.from || te.NewName != c.to {
+						t.Errorf("unexpected rename edit %+v", te)
+					}
+				}
+			}
+			if renames != c.renames {
+				t.Errorf("got %v rename edits, want %v", renames, c.renames)
+			}
+		})
+	}
+}
+
+// applyTextEdits applies LSP style text edits to the ASCII text src.
+func applyTextEdits(t *testing.T, src string, edits []TextEdit) string {
+	starts := []int{0}
+	for i := range src {
+		if src[i] == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	offset := func(p Position) int {
+		return starts[p.Line] + p.Character
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, e := range edits {
+		start, end := offset(e.Range.Start), offset(e.Range.End)
+		if start < last {
+			t.Fatalf("overlapping text edit %+v", e)
+		}
+		sb.WriteString(src[last:start])
+		sb.WriteString(e.NewText)
+		last = end
+	}
+	sb.WriteString(src[last:])
+	return sb.String()
+}
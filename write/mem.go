@@ -0,0 +1,29 @@
+package write
+
+// MemWriter captures all files written in memory, instead of modifying any
+// file. Removed files are recorded with nil content. MemWriter is meant for
+// testing refactorings.
+type MemWriter struct {
+	Files ChangeSet
+}
+
+// NewMemWriter creates an empty in-memory writer.
+func NewMemWriter() *MemWriter {
+	return &MemWriter{Files: ChangeSet{}}
+}
+
+func (w *MemWriter) Write(filename string, content []byte) error {
+	if content == nil {
+		w.Files.Remove(filename)
+		return nil
+	}
+	w.Files[filename] = append([]byte{}, content...)
+	return nil
+}
+
+func (w *MemWriter) WriteAll(changes ChangeSet) error {
+	for filename, content := range changes {
+		w.Write(filename, content)
+	}
+	return nil
+}
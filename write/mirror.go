@@ -0,0 +1,251 @@
+package write
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MirrorMode selects how files not modified are mirrored.
+type MirrorMode uint8
+
+const (
+	// MirrorNone writes modified files only.
+	MirrorNone MirrorMode = iota
+
+	// MirrorCopy copies all unmodified files into the mirror.
+	MirrorCopy
+
+	// MirrorSymlink creates symlinks to the unmodified files.
+	MirrorSymlink
+)
+
+var mirrorModes = map[string]MirrorMode{
+	"":        MirrorNone,
+	"none":    MirrorNone,
+	"copy":    MirrorCopy,
+	"symlink": MirrorSymlink,
+}
+
+// ParseMirrorMode parses the mirror mode names 'none', 'copy' and
+// 'symlink'.
+func ParseMirrorMode(s string) (MirrorMode, error) {
+	mode, ok := mirrorModes[s]
+	if !ok {
+		return MirrorNone, fmt.Errorf("invalid mirror mode '%v' (must be one of none, copy, symlink)", s)
+	}
+	return mode, nil
+}
+
+type mirrorWriter struct {
+	root    string
+	dir     string
+	mode    MirrorMode
+	overlay map[string][]byte
+
+	written  map[string]bool // mirrored files holding modified contents
+	mirrored bool
+}
+
+// NewMirrorWriter creates a writer writing modified files into a mirror of
+// the source tree in root under dir, instead of modifying the original
+// files. Depending on mode, the unmodified files of the source tree are
+// copied or symlinked into the mirror, such that the mirror can be built
+// and tested. Files in overlay are always copied with their overlay
+// contents. Files removed by a change set are not mirrored.
+func NewMirrorWriter(root, dir string, mode MirrorMode, overlay map[string][]byte) Writer {
+	return &mirrorWriter{
+		root:    root,
+		dir:     dir,
+		mode:    mode,
+		overlay: overlay,
+		written: map[string]bool{},
+	}
+}
+
+func (w *mirrorWriter) Write(filename string, content []byte) error {
+	return w.WriteAll(ChangeSet{filename: content})
+}
+
+func (w *mirrorWriter) WriteAll(changes ChangeSet) error {
+	root, dir, err := w.dirs()
+	if err != nil {
+		return err
+	}
+
+	var failed []FileError
+	for _, filename := range changes.Files() {
+		target, err := w.target(root, dir, filename)
+		if err == nil {
+			if content := changes[filename]; content == nil {
+				err = removeMirrorFile(target)
+			} else {
+				err = writeMirrorFile(filename, target, content)
+			}
+		}
+		if err != nil {
+			failed = append(failed, FileError{filename, err})
+			continue
+		}
+		w.written[target] = true
+	}
+	if len(failed) > 0 {
+		return &ApplyError{Failed: failed}
+	}
+
+	if w.mode == MirrorNone || w.mirrored {
+		return nil
+	}
+	w.mirrored = true
+	return w.mirror(root, dir)
+}
+
+// dirs returns the absolute source and mirror directories.
+func (w *mirrorWriter) dirs() (root, dir string, err error) {
+	root = w.root
+	if root == "" {
+		root = "."
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return "", "", err
+	}
+	if dir, err = filepath.Abs(w.dir); err != nil {
+		return "", "", err
+	}
+	if dir == root {
+		return "", "", fmt.Errorf("mirror directory %v must not be the source directory", dir)
+	}
+	return root, dir, nil
+}
+
+// target returns the path of filename in the mirror.
+func (w *mirrorWriter) target(root, dir, filename string) (string, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file is not located in %v", root)
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// mirror copies or links all files in root not written yet into dir.
+// Version control directories, the undo journals and the mirror itself are
+// skipped. Overlay files outside of root are ignored.
+func (w *mirrorWriter) mirror(root, dir string) error {
+	var failed []FileError
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			failed = append(failed, FileError{path, err})
+			return nil
+		}
+		if fi.IsDir() {
+			switch name := fi.Name(); {
+			case path == dir:
+				return filepath.SkipDir
+			case path != root && (name == ".git" || name == ".hg" || name == ".svn" || name == ".gotools"):
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() && fi.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		if _, ok := w.overlay[path]; ok {
+			return nil
+		}
+
+		target, err := w.target(root, dir, path)
+		if err != nil || w.written[target] {
+			return err
+		}
+		if err := w.mirrorFile(path, target); err != nil {
+			failed = append(failed, FileError{path, err})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Overlay files might not have been saved to disk yet.
+	for path := range w.overlay {
+		target, err := w.target(root, dir, path)
+		if err != nil || w.written[target] {
+			continue
+		}
+		if err := w.mirrorFile(path, target); err != nil {
+			failed = append(failed, FileError{path, err})
+		}
+	}
+	if len(failed) > 0 {
+		return &ApplyError{Failed: failed}
+	}
+	return nil
+}
+
+func (w *mirrorWriter) mirrorFile(path, target string) error {
+	if content, ok := w.overlay[path]; ok {
+		return writeMirrorFile(path, target, content)
+	}
+
+	if w.mode == MirrorSymlink {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+		return os.Symlink(path, target)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return writeMirrorFile(path, target, content)
+}
+
+// writeMirrorFile writes content to target, with the mode of the source
+// file. Symlinks created by a previous run are replaced, instead of
+// writing to the source file they point to.
+func writeMirrorFile(source, target string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := removeLink(target); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(target, content); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(source); err == nil {
+		return os.Chmod(target, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// removeMirrorFile removes a file removed by the change set from the
+// mirror, in case it has been mirrored by a previous run.
+func removeMirrorFile(target string) error {
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeLink removes filename if it is a symlink.
+func removeLink(filename string) error {
+	fi, err := os.Lstat(filename)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(filename)
+}
@@ -0,0 +1,259 @@
+package write
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// nullHash is the hash of a file that does not exist.
+const nullHash = "0000000000000000000000000000000000000000"
+
+// blobHash returns the git blob hash of content.
+func blobHash(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type patchWriter struct {
+	filename string
+	opts     DiffOptions
+}
+
+// NewPatchWriter creates a writer collecting all changes into the patch file
+// filename instead of modifying any file. The patch is a unified diff
+// holding the git blob hashes of the original and new contents of every
+// file. The patch can be applied with ApplyPatch or 'git apply'.
+func NewPatchWriter(filename string, opts DiffOptions) Writer {
+	opts.Color = false
+	opts.Hashes = true
+	return &patchWriter{filename: filename, opts: opts}
+}
+
+func (w *patchWriter) Write(filename string, content []byte) error {
+	return w.WriteAll(ChangeSet{filename: content})
+}
+
+func (w *patchWriter) WriteAll(changes ChangeSet) error {
+	var buf bytes.Buffer
+	diffs := NewUnifiedDiffWriter(&buf, w.opts)
+	if err := WriteAll(diffs, changes); err != nil {
+		return err
+	}
+	return writeFileAtomic(w.filename, buf.Bytes())
+}
+
+// filePatch is the patch of a single file.
+type filePatch struct {
+	name     string
+	origHash string
+	newHash  string
+	mode     os.FileMode // mode of a new file, 0 if not given
+	hunks    []patchHunk
+}
+
+type patchHunk struct {
+	origStart, origLen int
+	lines              []string // diff lines including prefix and line terminator
+}
+
+// ReadPatch reads a patch file written by the patch writer and applies it to
+// the files in root. The patched contents are returned without modifying
+// any file, together with the modes of the files created. ReadPatch fails
+// if the current content of any file does not match the original content
+// the patch has been created from.
+func ReadPatch(filename, root string) (ChangeSet, FileModes, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	patches, err := parsePatch(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", filename, err)
+	}
+
+	changes := ChangeSet{}
+	modes := FileModes{}
+	var failed []FileError
+	for _, p := range patches {
+		path := filepath.Join(root, filepath.FromSlash(p.name))
+		content, err := p.apply(path)
+		if err != nil {
+			failed = append(failed, FileError{path, err})
+			continue
+		}
+		changes[path] = content
+		if p.mode != 0 {
+			modes[path] = p.mode
+		}
+	}
+	if len(failed) > 0 {
+		return nil, nil, &ApplyError{Failed: failed}
+	}
+	return changes, modes, nil
+}
+
+func parsePatch(data []byte) ([]*filePatch, error) {
+	var patches []*filePatch
+	var cur *filePatch
+	var hunk *patchHunk
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, 16*1024*1024)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := s.Text()
+
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			fields := strings.Fields(line)
+			if len(fields) != 4 || !strings.HasPrefix(fields[3], "b/") {
+				return nil, fmt.Errorf("line %v: invalid file header", lineno)
+			}
+			cur = &filePatch{name: strings.TrimPrefix(fields[3], "b/")}
+			hunk = nil
+			patches = append(patches, cur)
+
+		case cur == nil:
+			// ignore leading text
+
+		case hunk == nil && strings.HasPrefix(line, "index "):
+			hashes := strings.Fields(line)[1]
+			i := strings.Index(hashes, "..")
+			if i < 0 {
+				return nil, fmt.Errorf("line %v: invalid index line", lineno)
+			}
+			cur.origHash, cur.newHash = hashes[:i], hashes[i+2:]
+
+		case strings.HasPrefix(line, "@@ "):
+			fields := strings.Fields(line)
+			if len(fields) < 3 || !strings.HasPrefix(fields[1], "-") {
+				return nil, fmt.Errorf("line %v: invalid hunk header", lineno)
+			}
+			start, n, err := parseRange(fields[1][1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %v: invalid hunk header", lineno)
+			}
+			cur.hunks = append(cur.hunks, patchHunk{origStart: start, origLen: n})
+			hunk = &cur.hunks[len(cur.hunks)-1]
+
+		case hunk == nil && strings.HasPrefix(line, "new file mode "):
+			mode, err := strconv.ParseUint(strings.TrimPrefix(line, "new file mode "), 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: invalid file mode", lineno)
+			}
+			cur.mode = os.FileMode(mode).Perm()
+
+		case hunk == nil:
+			// file header lines (---, +++, deleted file mode)
+
+		case strings.HasPrefix(line, `\`):
+			// No newline at end of file: applies to the previous line
+			if n := len(hunk.lines); n > 0 {
+				hunk.lines[n-1] = strings.TrimSuffix(hunk.lines[n-1], "\n")
+			}
+
+		case line == "":
+			hunk.lines = append(hunk.lines, " \n")
+
+		case line[0] == ' ' || line[0] == '-' || line[0] == '+':
+			hunk.lines = append(hunk.lines, line+"\n")
+
+		default:
+			return nil, fmt.Errorf("line %v: unexpected line in hunk", lineno)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return patches, nil
+}
+
+func parseRange(s string) (start, n int, err error) {
+	n = 1
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		if n, err = strconv.Atoi(s[i+1:]); err != nil {
+			return 0, 0, err
+		}
+		s = s[:i]
+	}
+	start, err = strconv.Atoi(s)
+	return start, n, err
+}
+
+// apply applies the patch to the file path, checking that the file matches
+// the original content hash of the patch.
+func (p *filePatch) apply(path string) ([]byte, error) {
+	if p.origHash == "" || p.newHash == "" {
+		return nil, errors.New("patch has no base hashes")
+	}
+
+	orig, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) || p.origHash != nullHash {
+			return nil, err
+		}
+	} else if blobHash(orig) != p.origHash {
+		return nil, errors.New("file has been changed since the patch was created")
+	}
+
+	lines := splitLines(orig)
+	var out bytes.Buffer
+	pos := 0
+	for _, h := range p.hunks {
+		// Empty ranges name the line preceding the change.
+		start := h.origStart
+		if h.origLen > 0 {
+			start--
+		}
+		if start < pos || start > len(lines) {
+			return nil, fmt.Errorf("hunk at line %v out of range", h.origStart)
+		}
+		for ; pos < start; pos++ {
+			out.WriteString(lines[pos])
+		}
+
+		for _, l := range h.lines {
+			op, text := l[0], l[1:]
+			switch op {
+			case ' ', '-':
+				if pos >= len(lines) || lines[pos] != text {
+					return nil, fmt.Errorf("hunk at line %v does not match", h.origStart)
+				}
+				if op == ' ' {
+					out.WriteString(text)
+				}
+				pos++
+			case '+':
+				out.WriteString(text)
+			}
+		}
+	}
+	for ; pos < len(lines); pos++ {
+		out.WriteString(lines[pos])
+	}
+
+	// Removed files are returned as nil content.
+	if p.newHash == nullHash {
+		if out.Len() > 0 {
+			return nil, errors.New("file to be removed does not match the patch")
+		}
+		return nil, nil
+	}
+	if blobHash(out.Bytes()) != p.newHash {
+		return nil, errors.New("patched content does not match the hash recorded in the patch")
+	}
+	return append([]byte{}, out.Bytes()...), nil
+}
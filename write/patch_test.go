@@ -0,0 +1,58 @@
+package write
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPatchFileModes(t *testing.T) {
+	root := t.TempDir()
+	old := filepath.Join(root, "old", "run.go")
+	moved := filepath.Join(root, "new", "run.go")
+	if err := os.MkdirAll(filepath.Dir(old), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(old, []byte("package old\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(old, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	modes := FileModes{}
+	if err := modes.Move(old, moved); err != nil {
+		t.Fatal(err)
+	}
+	changes := ChangeSet{moved: []byte("package moved\n")}
+	changes.Remove(old)
+
+	patch := filepath.Join(t.TempDir(), "move.patch")
+	w := NewPatchWriter(patch, DiffOptions{Context: 3, Root: root, Modes: modes})
+	if err := WriteAll(w, changes); err != nil {
+		t.Fatal(err)
+	}
+
+	patched, patchModes, err := ReadPatch(patch, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := patchModes[moved]; got != 0755 {
+		t.Errorf("patch creates %v with mode %v, want %v", moved, got, os.FileMode(0755))
+	}
+	if err := WriteAll(NewFileWriter(patchModes), patched); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0755 {
+		t.Errorf("created %v with mode %v, want %v", moved, got, os.FileMode(0755))
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("%v has not been removed", old)
+	}
+}
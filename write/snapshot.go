@@ -0,0 +1,92 @@
+package write
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// ErrModified is reported for files modified on disk after they have been
+// loaded.
+var ErrModified = errors.New("file has been modified since it was loaded, not overwriting it")
+
+// Snapshot maps file names to the hex encoded SHA-256 hashes of their
+// contents at the time they have been loaded (see load.Program.Hashes).
+type Snapshot map[string]string
+
+// Add merges hashes into the snapshot. Hashes already recorded are kept,
+// such that a file changed between loading multiple programs is reported
+// as modified.
+func (s Snapshot) Add(hashes map[string]string) {
+	for filename, hash := range hashes {
+		if _, exists := s[filename]; !exists {
+			s[filename] = hash
+		}
+	}
+}
+
+// Check returns ErrModified if the file on disk does not match the
+// snapshot. Files not found in the snapshot are not checked.
+func (s Snapshot) Check(filename string) error {
+	if _, ok := s[filename]; !ok {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrModified
+		}
+		return err
+	}
+	return s.verify(filename, content)
+}
+
+func (s Snapshot) verify(filename string, content []byte) error {
+	if hash, ok := s[filename]; ok && hash != hashContent(content) {
+		return ErrModified
+	}
+	return nil
+}
+
+// Writer returns a writer checking all files against the snapshot before
+// passing them to w. Change sets are refused as a whole if any of the files
+// has been modified.
+//
+// If w writes files in place (see NewFileWriter), the files are checked
+// again right before replacing them. Otherwise files modified between the
+// check and w writing them are overwritten.
+func (s Snapshot) Writer(w Writer) Writer {
+	return &snapshotWriter{s: s, w: w}
+}
+
+type snapshotWriter struct {
+	s Snapshot
+	w Writer
+}
+
+// verifyingWriter is implemented by writers able to verify the original
+// contents of the files they replace.
+type verifyingWriter interface {
+	writeAllVerified(changes ChangeSet, verify func(filename string, orig []byte) error) error
+}
+
+func (sw *snapshotWriter) Write(filename string, content []byte) error {
+	return sw.WriteAll(ChangeSet{filename: content})
+}
+
+func (sw *snapshotWriter) WriteAll(changes ChangeSet) error {
+	var failed []FileError
+	for _, filename := range changes.Files() {
+		if err := sw.s.Check(filename); err != nil {
+			failed = append(failed, FileError{filename, err})
+		}
+	}
+	if len(failed) > 0 {
+		return &ApplyError{Failed: failed}
+	}
+	if vw, ok := sw.w.(verifyingWriter); ok {
+		return vw.writeAllVerified(changes, sw.s.verify)
+	}
+	return WriteAll(sw.w, changes)
+}
@@ -0,0 +1,224 @@
+package write
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// EditSet collects edits by file name.
+type EditSet map[string][]Edit
+
+// Add records an edit.
+func (es EditSet) Add(e Edit) {
+	es[e.Filename] = append(es[e.Filename], e)
+}
+
+// Files returns the names of all files with edits in sorted order.
+func (es EditSet) Files() []string {
+	files := make([]string, 0, len(es))
+	for file := range es {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Apply splices the edits into the original contents of the files, read
+// from overlay or disk. Unlike pretty-printing the modified syntax tree,
+// the original formatting and comments are kept. gofmt is only applied to
+// the blocks of lines containing an edit, realigning columns whose width
+// has been changed by the edit (e.g. struct fields). Files read from disk
+// are verified against snapshot, if not nil.
+func (es EditSet) Apply(overlay map[string][]byte, snapshot Snapshot) (ChangeSet, error) {
+	changes := ChangeSet{}
+	var failed []FileError
+	for _, filename := range es.Files() {
+		orig, err := readOrig(overlay, filename)
+		if _, ok := overlay[filename]; err == nil && !ok {
+			err = snapshot.verify(filename, orig)
+		}
+		if err == nil {
+			changes[filename], err = Splice(orig, es[filename])
+		}
+		if err != nil {
+			failed = append(failed, FileError{filename, err})
+		}
+	}
+	if len(failed) > 0 {
+		return nil, &ApplyError{Failed: failed}
+	}
+	return changes, nil
+}
+
+// Splice applies the edits to src and realigns the blocks of lines
+// containing edits with gofmt.
+func Splice(src []byte, edits []Edit) ([]byte, error) {
+	edits, err := normalizeEdits(src, edits)
+	if err != nil {
+		return nil, err
+	}
+
+	spliced, editLines, multiline := splice(src, edits)
+	if multiline {
+		return spliced, nil
+	}
+	return realign(src, spliced, editLines), nil
+}
+
+// splice applies the normalized edits to src without realigning the
+// result. splice returns the lines containing edits, and whether any edit
+// adds or removes lines.
+func splice(src []byte, edits []Edit) ([]byte, []int, bool) {
+	var buf bytes.Buffer
+	var editLines []int
+	last, line, multiline := 0, 0, false
+	for _, e := range edits {
+		line += bytes.Count(src[last:e.Offset], []byte("\n"))
+		editLines = append(editLines, line)
+		buf.Write(src[last:e.Offset])
+		buf.WriteString(e.NewText)
+		multiline = multiline || strings.Contains(e.NewText, "\n") ||
+			bytes.Contains(src[e.Offset:e.End], []byte("\n"))
+		last = e.End
+	}
+	buf.Write(src[last:])
+	return buf.Bytes(), editLines, multiline
+}
+
+// normalizeEdits sorts the edits by offset and validates them against src.
+// Identifiers shared by multiple build configurations or package variants
+// are reported more than once and merged. If an identifier has been renamed
+// multiple times, the last edit wins.
+func normalizeEdits(src []byte, edits []Edit) ([]Edit, error) {
+	edits = append([]Edit(nil), edits...)
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].Offset < edits[j].Offset
+	})
+
+	var result []Edit
+	for _, e := range edits {
+		if e.Offset < 0 || e.End < e.Offset || e.End > len(src) {
+			return nil, fmt.Errorf("edit %v-%v out of range", e.Offset, e.End)
+		}
+
+		if n := len(result); n > 0 {
+			prev := &result[n-1]
+			if e.Offset == prev.Offset && e.End == prev.End {
+				e.OldName = prev.OldName
+				*prev = e
+				continue
+			}
+			if e.Offset < prev.End {
+				return nil, fmt.Errorf("overlapping edits at offset %v", e.Offset)
+			}
+		}
+		if e.OldName != "" && string(src[e.Offset:e.End]) != e.OldName {
+			return nil, fmt.Errorf("file does not contain %v at offset %v", e.OldName, e.Offset)
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// realign formats src with gofmt, but only keeps the formatting changes of
+// the blocks of non-blank lines containing any of the given lines. Blocks
+// not formatted in orig are left alone, such that only changes caused by
+// the edits are applied. orig and src must have the same number of lines.
+// src is returned unchanged if it can not be formatted.
+func realign(orig, src []byte, lines []int) []byte {
+	formatted, err := format.Source(src)
+	if err != nil || bytes.Equal(formatted, src) {
+		return src
+	}
+
+	a, b := splitLines(src), splitLines(formatted)
+	blocks := make([]bool, len(a))
+	for _, line := range lines {
+		start, end := line, line+1
+		for start > 0 && !isBlank(a[start-1]) {
+			start--
+		}
+		for end < len(a) && !isBlank(a[end]) {
+			end++
+		}
+		for i := start; i < end; i++ {
+			blocks[i] = true
+		}
+	}
+
+	// Unmark the blocks holding lines gofmt would change in orig.
+	if formattedOrig, err := format.Source(orig); err == nil {
+		unmark := func(line int) {
+			if line < 0 || line >= len(a) || !blocks[line] {
+				return
+			}
+			for i := line; i >= 0 && blocks[i]; i-- {
+				blocks[i] = false
+			}
+			for i := line + 1; i < len(a) && blocks[i]; i++ {
+				blocks[i] = false
+			}
+		}
+		for _, e := range diffLines(splitLines(orig), splitLines(formattedOrig)) {
+			switch e.kind {
+			case opDelete:
+				unmark(e.a)
+			case opInsert:
+				// Lines inserted by gofmt belong to the surrounding lines.
+				unmark(e.a - 1)
+				unmark(e.a)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	edits := diffLines(a, b)
+	for i := 0; i < len(edits); {
+		if edits[i].kind == opEqual {
+			buf.WriteString(a[edits[i].a])
+			i++
+			continue
+		}
+
+		// Keep the formatted lines of a run of changes only if all
+		// original lines of the run are part of an edited block. Lines
+		// only inserted must follow or precede an edited block.
+		j, keep, deletes := i, true, 0
+		for ; j < len(edits) && edits[j].kind != opEqual; j++ {
+			if edits[j].kind == opDelete {
+				deletes++
+				keep = keep && blocks[edits[j].a]
+			}
+		}
+		if deletes == 0 {
+			at := edits[i].a
+			keep = (at > 0 && blocks[at-1]) || (at < len(a) && blocks[at])
+		}
+		for _, e := range edits[i:j] {
+			switch {
+			case keep && e.kind == opInsert:
+				buf.WriteString(b[e.b])
+			case !keep && e.kind == opDelete:
+				buf.WriteString(a[e.a])
+			}
+		}
+		i = j
+	}
+	return buf.Bytes()
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// readOrig reads filename from overlay, falling back to the file on disk.
+func readOrig(overlay map[string][]byte, filename string) ([]byte, error) {
+	if content, ok := overlay[filename]; ok {
+		return content, nil
+	}
+	return ioutil.ReadFile(filename)
+}
@@ -0,0 +1,203 @@
+package write
+
+import (
+	"strings"
+	"testing"
+)
+
+// rename returns the edit renaming the first occurrence of from after the
+// marker in src.
+func rename(t *testing.T, src, marker, from, to string) Edit {
+	i := strings.Index(src, marker)
+	if i < 0 {
+		t.Fatalf("%q not found", marker)
+	}
+	j := strings.Index(src[i:], from)
+	if j < 0 {
+		t.Fatalf("%q not found after %q", from, marker)
+	}
+	return Edit{Offset: i + j, End: i + j + len(from), NewText: to, OldName: from, NewName: to}
+}
+
+func TestSplice(t *testing.T) {
+	cases := []struct {
+		name     string
+		src      string
+		edits    func(t *testing.T, src string) []Edit
+		expected string
+	}{
+		{
+			name: "rename",
+			src: `package p
+
+func F() int { return 1 }
+
+var x = F()
+`,
+			edits: func(t *testing.T, src string) []Edit {
+				return []Edit{
+					rename(t, src, "var", "F", "Get"),
+					rename(t, src, "func", "F", "Get"),
+				}
+			},
+			expected: `package p
+
+func Get() int { return 1 }
+
+var x = Get()
+`,
+		},
+		{
+			name: "realign struct fields",
+			src: `package p
+
+type T struct {
+	A   int // a
+	Bcd int // bcd
+}
+
+type U struct {
+	X int
+	Y     string
+}
+`,
+			edits: func(t *testing.T, src string) []Edit {
+				return []Edit{rename(t, src, "Bcd", "Bcd", "B")}
+			},
+			// The unformatted block of U is left alone.
+			expected: `package p
+
+type T struct {
+	A int // a
+	B int // bcd
+}
+
+type U struct {
+	X int
+	Y     string
+}
+`,
+		},
+		{
+			name: "keep unformatted block",
+			src: `package p
+
+type T struct {
+	A    int
+	Bcd int
+}
+`,
+			edits: func(t *testing.T, src string) []Edit {
+				return []Edit{rename(t, src, "Bcd", "Bcd", "Bc")}
+			},
+			expected: `package p
+
+type T struct {
+	A    int
+	Bc int
+}
+`,
+		},
+		{
+			name: "duplicate edits",
+			src: `package p
+
+var aB = 1
+`,
+			edits: func(t *testing.T, src string) []Edit {
+				e := rename(t, src, "var", "aB", "ab")
+				return []Edit{e, e}
+			},
+			expected: `package p
+
+var ab = 1
+`,
+		},
+		{
+			name: "last edit wins",
+			src: `package p
+
+var aB = 1
+`,
+			edits: func(t *testing.T, src string) []Edit {
+				e := rename(t, src, "var", "aB", "ab")
+				e2 := e
+				e2.OldName, e2.NewText, e2.NewName = "ab", "abc", "abc"
+				return []Edit{e, e2}
+			},
+			expected: `package p
+
+var abc = 1
+`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := Splice([]byte(c.src), c.edits(t, c.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != c.expected {
+				t.Errorf("unexpected result:\n%s\nwant:\n%s", got, c.expected)
+			}
+		})
+	}
+}
+
+func TestSpliceErrors(t *testing.T) {
+	src := "package p\n\nvar abc = 1\n"
+	at := strings.Index(src, "abc")
+	cases := []struct {
+		name  string
+		edits []Edit
+		err   string
+	}{
+		{
+			name:  "out of range",
+			edits: []Edit{{Offset: len(src), End: len(src) + 1, NewText: "x"}},
+			err:   "out of range",
+		},
+		{
+			name: "overlapping",
+			edits: []Edit{
+				{Offset: at, End: at + 2, NewText: "x"},
+				{Offset: at + 1, End: at + 3, NewText: "y"},
+			},
+			err: "overlapping edits",
+		},
+		{
+			name:  "old name mismatch",
+			edits: []Edit{{Offset: at, End: at + 3, NewText: "x", OldName: "abd"}},
+			err:   "does not contain abd",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Splice([]byte(src), c.edits)
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("expected error containing %q, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestEditSetApply(t *testing.T) {
+	overlay := map[string][]byte{
+		"/a.go": []byte("package p\n\nvar aB = 1\n"),
+	}
+	edits := EditSet{}
+	edits.Add(Edit{Filename: "/a.go", Offset: 15, End: 17, NewText: "ab", OldName: "aB"})
+
+	changes, err := edits.Apply(overlay, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := string(changes["/a.go"]), "package p\n\nvar ab = 1\n"; got != expected {
+		t.Errorf("unexpected result %q, want %q", got, expected)
+	}
+
+	edits.Add(Edit{Filename: "/b.go", Offset: 0, End: 1, NewText: "x"})
+	if _, err := edits.Apply(overlay, nil); err == nil {
+		t.Errorf("expected error applying edits to a missing file")
+	}
+}
@@ -2,6 +2,7 @@ package write
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -13,30 +14,131 @@ type Writer interface {
 
 type funcWriter func(string, []byte) error
 
-var fileWriter = funcWriter(func(filename string, content []byte) error {
-	return ioutil.WriteFile(filename, content, 0644)
-})
+// fileWriter writes files in place. Change sets are applied all-or-nothing.
+type fileWriter struct {
+	modes FileModes
+}
+
+// Options configures the writer created by CreateWriter.
+type Options struct {
+	// Diff prints the changes as unified diff instead of modifying files.
+	Diff bool
+
+	// DiffCmd is the external diff command used to print diffs. If empty,
+	// the built-in unified diff is printed.
+	DiffCmd string
+
+	// Out receives the diff or JSON output. If nil, os.Stdout is used.
+	Out io.Writer
+
+	// Patch collects all changes into the given patch file instead of
+	// modifying files. See NewPatchWriter.
+	Patch string
+
+	// OutDir writes the modified files into a mirror of the source tree in
+	// Root under OutDir, instead of modifying files. Mirror selects whether
+	// unmodified files are copied or symlinked into the mirror. See
+	// NewMirrorWriter.
+	OutDir string
+	Mirror MirrorMode
+
+	// JSON prints Edits as JSON instead of modifying files. See
+	// NewJSONWriter.
+	JSON  bool
+	Edits EditSet
+
+	// Snapshot holds the hashes of the files as loaded. Snapshot and Edits
+	// can be filled after the writer has been created.
+	Snapshot Snapshot
+
+	DiffOptions
+}
+
+// CreateWriter creates the writer for the command line flags. Diffs are
+// computed against the overlay contents of files found in opts.Overlay.
+// If opts.Snapshot is not nil, the writer refuses to write files modified
+// on disk since they have been loaded.
+func CreateWriter(opts Options) (Writer, error) {
+	w, err := createWriter(opts)
+	if err != nil || opts.Snapshot == nil {
+		return w, err
+	}
+	return opts.Snapshot.Writer(w), nil
+}
+
+func createWriter(opts Options) (Writer, error) {
+	if opts.Patch != "" {
+		return NewPatchWriter(opts.Patch, opts.DiffOptions), nil
+	}
 
-func CreateWriter(diff bool, diffcmd string) (Writer, error) {
-	if !diff {
-		return NewFileWriter(), nil
+	out := opts.Out
+	if out == nil {
+		out = os.Stdout
 	}
-	return NewDiffWriter(diffcmd), nil
+	if opts.JSON {
+		return NewJSONWriter(out, opts.Overlay, opts.Edits), nil
+	}
+	if opts.OutDir != "" {
+		return NewMirrorWriter(opts.Root, opts.OutDir, opts.Mirror, opts.Overlay), nil
+	}
+	if !opts.Diff {
+		return NewFileWriter(opts.Modes), nil
+	}
+	if opts.DiffCmd != "" {
+		return NewOverlayDiffWriter(opts.DiffCmd, opts.Overlay), nil
+	}
+	return NewUnifiedDiffWriter(out, opts.DiffOptions), nil
 }
 
-func NewFileWriter() Writer {
-	return fileWriter
+// NewFileWriter creates a writer modifying files in place. New files are
+// created with the mode found in modes.
+func NewFileWriter(modes FileModes) Writer {
+	return fileWriter{modes: modes}
+}
+
+func (w fileWriter) Write(filename string, content []byte) error {
+	if content == nil {
+		return os.Remove(filename)
+	}
+	return w.WriteAll(ChangeSet{filename: content})
+}
+
+func (w fileWriter) WriteAll(changes ChangeSet) error {
+	return applyChangeSet(changes, w.modes, nil)
+}
+
+func (w fileWriter) writeAllVerified(changes ChangeSet, verify func(string, []byte) error) error {
+	return applyChangeSet(changes, w.modes, verify)
 }
 
 func NewDiffWriter(diffCmd string) Writer {
+	return NewOverlayDiffWriter(diffCmd, nil)
+}
+
+// NewOverlayDiffWriter is like NewDiffWriter, but diffs files found in
+// overlay against their overlay contents instead of the files on disk.
+func NewOverlayDiffWriter(diffCmd string, overlay map[string][]byte) Writer {
 	return funcWriter(func(filename string, content []byte) error {
+		orig := filename
+		if buf, ok := overlay[filename]; ok {
+			orig = fmt.Sprintf("%s.%d.overlay", filename, os.Getpid())
+			if err := ioutil.WriteFile(orig, buf, 0644); err != nil {
+				return err
+			}
+			defer os.Remove(orig)
+		}
+
+		// Removed files are diffed against a missing file, which -N treats
+		// as empty.
 		renamed := fmt.Sprintf("%s.%d.renamed", filename, os.Getpid())
-		if err := ioutil.WriteFile(renamed, content, 0644); err != nil {
-			return err
+		if content != nil {
+			if err := ioutil.WriteFile(renamed, content, 0644); err != nil {
+				return err
+			}
+			defer os.Remove(renamed)
 		}
-		defer os.Remove(renamed)
 
-		diff, err := exec.Command(diffCmd, "-u", filename, renamed).CombinedOutput()
+		diff, err := exec.Command(diffCmd, "-u", "-N", orig, renamed).CombinedOutput()
 		if len(diff) > 0 {
 			// diff exits with a non-zero status when the files don't match.
 			// Ignore that failure as long as we get output.